@@ -19,9 +19,13 @@
 package monitoring
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/prometheus/client_golang/prometheus"
@@ -38,6 +42,9 @@ import (
 const (
 	defaultPort = 8443
 	defaultHost = "0.0.0.0"
+
+	// how long the requests in progress can take to complete once asked to terminate
+	shutdownTimeout = 10 * time.Second
 )
 
 type App struct {
@@ -104,7 +111,12 @@ func (app *App) Run() {
 	}
 
 	conf.DebugMode = app.debugMode
-	conf.Validate()
+	// the same checks the reloads do: a configuration rejected on reload must not be accepted at boot
+	err = conf.Validate()
+	if err != nil {
+		log.Log.Infof("invalid configuration file %s: %v", args[0], err)
+		os.Exit(1)
+	}
 
 	if app.debugMode || app.checkMode {
 		spew.Fdump(os.Stderr, conf)
@@ -117,22 +129,79 @@ func (app *App) Run() {
 	log.Log.Infof("kubevirt-metrics-collector started")
 	defer log.Log.Infof("kubevirt-metrics-collector stopped")
 
-	co, err := processes.NewCollectorFromConf(conf)
-	if err == nil {
-		prometheus.MustRegister(co)
-	} else {
+	ctx, cancel := signalContext(syscall.SIGTERM, syscall.SIGINT)
+	defer cancel()
+
+	rc, err := processes.NewReloadableCollector(conf)
+	if err != nil {
 		log.Log.Warningf("error creating the collector: %v", err)
 		if !app.fakeMode {
 			os.Exit(2)
 		}
 	}
+	prometheus.MustRegister(rc)
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+	go rc.WatchConfig(args[0], processes.DefaultConfigPollInterval, hupCh, ctx.Done())
 
 	http.Handle("/metrics", promhttp.Handler())
-	if app.TLSInfo.IsEnabled() {
-		log.Log.Infof("TLS configured, serving over HTTPS")
-		log.Log.Infof("%s", http.ListenAndServeTLS(conf.ListenAddress, app.TLSInfo.CertFilePath, app.TLSInfo.KeyFilePath, nil))
-	} else {
-		log.Log.Infof("TLS *NOT* configured, serving over HTTP")
-		log.Log.Infof("%s", http.ListenAndServe(conf.ListenAddress, nil))
+	http.Handle("/healthz", processes.NewHealthHandler(rc.LivenessChecks))
+	http.Handle("/readyz", processes.NewHealthHandler(rc.ReadinessChecks))
+	err = app.serve(ctx, conf.ListenAddress)
+	if err != nil {
+		log.Log.Warningf("error serving the metrics: %v", err)
+	}
+
+	err = rc.Close()
+	if err != nil {
+		log.Log.Warningf("error closing the collector: %v", err)
+	}
+}
+
+// serve serves the registered handlers until ctx is done, then shuts down the server gracefully
+func (app *App) serve(ctx context.Context, addr string) error {
+	server := &http.Server{
+		Addr: addr,
 	}
+	errCh := make(chan error, 1)
+	go func() {
+		if app.TLSInfo.IsEnabled() {
+			log.Log.Infof("TLS configured, serving over HTTPS")
+			errCh <- server.ListenAndServeTLS(app.TLSInfo.CertFilePath, app.TLSInfo.KeyFilePath)
+		} else {
+			log.Log.Infof("TLS *NOT* configured, serving over HTTP")
+			errCh <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Log.Infof("shutting down, waiting up to %v for the requests in progress", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// signalContext returns a context which is done once any of the given signals is received.
+// Further signals get the default behaviour, so a second SIGTERM terminates the process at once.
+func signalContext(sigs ...os.Signal) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, sigs...)
+	go func() {
+		select {
+		case sig := <-sigCh:
+			log.Log.Infof("received %v, terminating", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigCh)
+	}()
+	return ctx, cancel
 }
@@ -33,46 +33,274 @@ const (
 	MalformedCGroup
 	UnknownCGroup
 	DockerCGroup
+	PodCGroup    // inside a kubepods pod slice, but not in any known container scope
+	SystemCGroup // outside kubepods, e.g. system.slice or init.scope
+	CRIOCGroup
+	CRIOConmonCGroup // the conmon process monitoring a CRI-O container, not the container itself
+	ContainerdCGroup
+	CgroupfsCGroup // cgroupfs driver layout: runtime-agnostic, the container ID is the leaf
 )
 
+// CGroupParser recognizes the cgroup path components of a given container runtime.
+type CGroupParser struct {
+	Name       string
+	Classifier int
+	// Container tells if the processes in the matching cgroups run inside a container, as opposed
+	// to e.g. the container monitor. Container cgroups are preferred when a process belongs to many.
+	Container bool
+	// Parse inspects the idx-th component of the cgroup path split in items.
+	// Returns the container ID and true if the component belongs to the runtime.
+	Parse func(items []string, idx int) (string, bool)
+}
+
+// CGroupParsers are tried in order on each cgroup path component, from the leaf up to the root.
+// More specific parsers must come first (e.g. crio-conmon before crio).
+var CGroupParsers = []CGroupParser{
+	NewScopeCGroupParser("docker", "docker-", DockerCGroup, true),
+	NewScopeCGroupParser("crio-conmon", "crio-conmon-", CRIOConmonCGroup, false),
+	NewScopeCGroupParser("crio", "crio-", CRIOCGroup, true),
+	NewScopeCGroupParser("containerd", "cri-containerd-", ContainerdCGroup, true),
+	{
+		Name:       "cgroupfs",
+		Classifier: CgroupfsCGroup,
+		Container:  true,
+		Parse:      parseCgroupfsItem,
+	},
+}
+
+// RegisterCGroupParser adds a new CGroupParser, which will be tried before all the existing ones.
+func RegisterCGroupParser(parser CGroupParser) {
+	CGroupParsers = append([]CGroupParser{parser}, CGroupParsers...)
+}
+
+// NewScopeCGroupParser creates a CGroupParser for the systemd cgroup driver naming, like
+// <prefix><container-id>.scope
+func NewScopeCGroupParser(name, prefix string, classifier int, container bool) CGroupParser {
+	return CGroupParser{
+		Name:       name,
+		Classifier: classifier,
+		Container:  container,
+		Parse: func(items []string, idx int) (string, bool) {
+			item := items[idx]
+			if !strings.HasPrefix(item, prefix) {
+				return "", false
+			}
+			return strings.TrimSuffix(item[len(prefix):], ".scope"), true
+		},
+	}
+}
+
+// parseCgroupfsItem handles the cgroupfs driver layout: /kubepods/burstable/pod<uid>/<id>
+// (guaranteed pods lack the QoS component)
+func parseCgroupfsItem(items []string, idx int) (string, bool) {
+	if idx == 0 || !isPodItem(items[idx-1]) || !isContainerID(items[idx]) {
+		return "", false
+	}
+	return items[idx], true
+}
+
+// isContainerID tells if the given string looks like a (full length, hex encoded) container ID
+func isContainerID(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// cgroups(7): on the unified (v2) hierarchy the hierarchy-ID is always 0
+// and the controller list is empty
+const unifiedHierarchyID = "0"
+
 // FindContainerIDByCGroup fetches cgroup information for the given PID
 // Returns the cgroup name and the CGroup classifier
-// Should the pid belong to more than one cgroup: returns the first one, in kernel order.
-func FindContainerIDByCGroup(pid int32) (string, int) {
-	return parseProcCGroupEntry(fmt.Sprintf("/proc/%d/cgroup", pid))
+// Should the pid belong to more than one cgroup: returns the first one, in kernel order,
+// that resolves to a container. Both the legacy (v1), the unified (v2) and the hybrid
+// cgroup hierarchies are supported.
+// procDir is the path where procfs is mounted (default: /proc)
+func FindContainerIDByCGroup(procDir string, pid int32) (string, int) {
+	return parseProcCGroupEntry(filepath.Join(procDir, fmt.Sprintf("%d", pid), "cgroup"))
 }
 
 func parseProcCGroupEntry(entry string) (string, int) {
 	file, err := os.Open(entry)
-	defer file.Close()
-
 	if err != nil {
 		return "", MissingCGroup
 	}
+	defer file.Close()
 
-	reader := bufio.NewReader(file)
-	line, isPrefix, err := reader.ReadLine()
-	if isPrefix || err != nil {
+	name, cgroupStyle := "", MissingCGroup
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineName, lineStyle := parseProcCGroupLine(scanner.Text())
+		if lineStyle == MalformedCGroup {
+			return "", MalformedCGroup
+		}
+		if isContainerCGroup(lineStyle) {
+			return lineName, lineStyle
+		}
+		// no container found (yet): the first line, in kernel order, wins
+		if cgroupStyle == MissingCGroup {
+			name, cgroupStyle = lineName, lineStyle
+		}
+	}
+	if scanner.Err() != nil {
 		return "", MissingCGroup
 	}
-
-	return parseProcCGroupLine(string(line))
+	return name, cgroupStyle
 }
 
 func parseProcCGroupLine(line string) (string, int) {
-	fields := strings.Split(line, ":")
+	fields := strings.SplitN(line, ":", 3)
 	// per cgroups(7):
 	// hierarchy-ID:controller-list:cgroup-path
 	if len(fields) != 3 {
 		return "", MalformedCGroup
 	}
-	name := filepath.Base(fields[2])
-	if strings.HasPrefix(name, "docker-") {
-		name = name[len("docker-"):]
-		if strings.HasSuffix(name, ".scope") {
-			name = name[:len(name)-len(".scope")]
+	if fields[0] == unifiedHierarchyID && fields[1] != "" {
+		return "", MalformedCGroup
+	}
+	return parseCGroupPath(fields[2])
+}
+
+// parseCGroupPath walks the cgroup path from the leaf up to the root, looking for the
+// container scope. Walking up is required on the unified hierarchy, where processes can only
+// live in leaf cgroups, so the runtimes (and libvirt) move them into nested child cgroups
+// under the container scope.
+// The path may also start with ".." components if the reader lives in a cgroup namespace.
+func parseCGroupPath(cgroupPath string) (string, int) {
+	items := strings.Split(cgroupPath, "/")
+	for idx := len(items) - 1; idx >= 0; idx-- {
+		for _, parser := range CGroupParsers {
+			if name, ok := parser.Parse(items, idx); ok {
+				return name, parser.Classifier
+			}
+		}
+	}
+
+	for idx := len(items) - 1; idx >= 0; idx-- {
+		if isPodSlice(items[idx]) || isPodItem(items[idx]) {
+			return items[idx], PodCGroup
 		}
-		return name, DockerCGroup
+	}
+
+	name := filepath.Base(cgroupPath)
+	top := topCGroupItem(items)
+	if top != "" && top != "kubepods" && top != "kubepods.slice" {
+		return name, SystemCGroup
 	}
 	return name, UnknownCGroup
 }
+
+// topCGroupItem returns the first meaningful component of a cgroup path, or empty if the
+// path is the (namespace) root.
+func topCGroupItem(items []string) string {
+	for _, item := range items {
+		if item != "" && item != ".." {
+			return item
+		}
+	}
+	return ""
+}
+
+// isPodSlice tells if the given cgroup path component is the one of a kubepods pod, like
+// kubepods-besteffort-pod34bb0aaa_c7f7_11e8_abe4_525400e651a6.slice
+func isPodSlice(item string) bool {
+	return strings.HasPrefix(item, "kubepods-") && strings.HasSuffix(item, ".slice") && strings.Contains(item, "-pod")
+}
+
+// isPodItem tells if the given cgroup path component is the one of a kubepods pod using the
+// cgroupfs driver, like pod34bb0aaa-c7f7-11e8-abe4-525400e651a6
+func isPodItem(item string) bool {
+	return strings.HasPrefix(item, "pod") && len(item) == len("pod")+36
+}
+
+// isContainerCGroup tells if the given classifier denotes a process running inside a container
+func isContainerCGroup(cgroupStyle int) bool {
+	for _, parser := range CGroupParsers {
+		if parser.Classifier == cgroupStyle {
+			return parser.Container
+		}
+	}
+	return false
+}
+
+// QoS classes of the kubepods, as encoded in the cgroup path
+const (
+	QOSGuaranteed = "guaranteed"
+	QOSBurstable  = "burstable"
+	QOSBestEffort = "besteffort"
+)
+
+// PodCGroupInfo is the pod identity encoded in the kubepods cgroup path
+type PodCGroupInfo struct {
+	UID      string
+	QOSClass string
+}
+
+// FindPodByCGroup fetches the pod identity for the given PID from its cgroup path.
+// procDir is the path where procfs is mounted (default: /proc)
+func FindPodByCGroup(procDir string, pid int32) (PodCGroupInfo, error) {
+	return parseProcCGroupPodEntry(filepath.Join(procDir, fmt.Sprintf("%d", pid), "cgroup"))
+}
+
+func parseProcCGroupPodEntry(entry string) (PodCGroupInfo, error) {
+	file, err := os.Open(entry)
+	if err != nil {
+		return PodCGroupInfo{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			return PodCGroupInfo{}, fmt.Errorf("malformed cgroup entry in %s", entry)
+		}
+		if info, ok := parseCGroupPodPath(fields[2]); ok {
+			return info, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return PodCGroupInfo{}, err
+	}
+	return PodCGroupInfo{}, fmt.Errorf("no pod cgroup found in %s", entry)
+}
+
+func parseCGroupPodPath(cgroupPath string) (PodCGroupInfo, bool) {
+	items := strings.Split(cgroupPath, "/")
+	for idx := len(items) - 1; idx >= 0; idx-- {
+		item := items[idx]
+		if isPodSlice(item) {
+			// kubepods-besteffort-pod34bb0aaa_c7f7_11e8_abe4_525400e651a6.slice
+			// kubepods-pod34bb0aaa_c7f7_11e8_abe4_525400e651a6.slice (guaranteed)
+			name := strings.TrimSuffix(strings.TrimPrefix(item, "kubepods-"), ".slice")
+			qos := QOSGuaranteed
+			if pos := strings.Index(name, "-pod"); pos >= 0 {
+				qos = name[:pos]
+				name = name[pos+1:]
+			}
+			return PodCGroupInfo{
+				UID:      strings.Replace(strings.TrimPrefix(name, "pod"), "_", "-", -1),
+				QOSClass: qos,
+			}, true
+		}
+		if isPodItem(item) {
+			// /kubepods/burstable/pod34bb0aaa-c7f7-11e8-abe4-525400e651a6
+			// /kubepods/pod34bb0aaa-c7f7-11e8-abe4-525400e651a6 (guaranteed)
+			qos := QOSGuaranteed
+			if idx > 0 && (items[idx-1] == QOSBurstable || items[idx-1] == QOSBestEffort) {
+				qos = items[idx-1]
+			}
+			return PodCGroupInfo{
+				UID:      strings.TrimPrefix(item, "pod"),
+				QOSClass: qos,
+			}, true
+		}
+	}
+	return PodCGroupInfo{}, false
+}
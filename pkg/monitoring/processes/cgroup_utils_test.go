@@ -19,7 +19,12 @@
 
 package processes
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestNoCgroupFile(t *testing.T) {
 	containerID, cgroupStyle := parseProcCGroupEntry("/this/path/does/not/exist")
@@ -70,3 +75,166 @@ func TestMalformedContent(t *testing.T) {
 		t.Errorf("unexpected cgroupStyle: %v", cgroupStyle)
 	}
 }
+
+func TestUnifiedDockerData(t *testing.T) {
+	containerID, cgroupStyle := parseProcCGroupEntry("testdata/cgroup-v2-docker")
+	if containerID != "8c2b4a7f3e91d05c6b1a2f4e8d7c9b0a3f5e6d1c2b4a8f7e9d0c1b2a3f4e5d6c" {
+		t.Errorf("unexpected containerID: %v", containerID)
+	}
+	if cgroupStyle != DockerCGroup {
+		t.Errorf("unexpected cgroupStyle: %v", cgroupStyle)
+	}
+}
+
+func TestUnifiedNestedData(t *testing.T) {
+	containerID, cgroupStyle := parseProcCGroupEntry("testdata/cgroup-v2-nested")
+	if containerID != "8c2b4a7f3e91d05c6b1a2f4e8d7c9b0a3f5e6d1c2b4a8f7e9d0c1b2a3f4e5d6c" {
+		t.Errorf("unexpected containerID: %v", containerID)
+	}
+	if cgroupStyle != DockerCGroup {
+		t.Errorf("unexpected cgroupStyle: %v", cgroupStyle)
+	}
+}
+
+func TestUnifiedNamespacedData(t *testing.T) {
+	containerID, cgroupStyle := parseProcCGroupEntry("testdata/cgroup-v2-namespaced")
+	if containerID != "8c2b4a7f3e91d05c6b1a2f4e8d7c9b0a3f5e6d1c2b4a8f7e9d0c1b2a3f4e5d6c" {
+		t.Errorf("unexpected containerID: %v", containerID)
+	}
+	if cgroupStyle != DockerCGroup {
+		t.Errorf("unexpected cgroupStyle: %v", cgroupStyle)
+	}
+}
+
+func TestUnifiedPodData(t *testing.T) {
+	containerID, cgroupStyle := parseProcCGroupEntry("testdata/cgroup-v2-pod")
+	if containerID != "kubepods-burstable-pod6a6a9b3d_5e8a_4a1c_9c4e_2b4f0c8d1e77.slice" {
+		t.Errorf("unexpected containerID: %v", containerID)
+	}
+	if cgroupStyle != PodCGroup {
+		t.Errorf("unexpected cgroupStyle: %v", cgroupStyle)
+	}
+}
+
+func TestUnifiedSystemData(t *testing.T) {
+	containerID, cgroupStyle := parseProcCGroupEntry("testdata/cgroup-v2-system")
+	if containerID != "kubelet.service" {
+		t.Errorf("unexpected containerID: %v", containerID)
+	}
+	if cgroupStyle != SystemCGroup {
+		t.Errorf("unexpected cgroupStyle: %v", cgroupStyle)
+	}
+}
+
+func TestHybridData(t *testing.T) {
+	containerID, cgroupStyle := parseProcCGroupEntry("testdata/cgroup-hybrid")
+	if containerID != "8c2b4a7f3e91d05c6b1a2f4e8d7c9b0a3f5e6d1c2b4a8f7e9d0c1b2a3f4e5d6c" {
+		t.Errorf("unexpected containerID: %v", containerID)
+	}
+	if cgroupStyle != DockerCGroup {
+		t.Errorf("unexpected cgroupStyle: %v", cgroupStyle)
+	}
+}
+
+func TestUnifiedMalformedLine(t *testing.T) {
+	_, cgroupStyle := parseProcCGroupLine("0:memory:/kubepods.slice")
+	if cgroupStyle != MalformedCGroup {
+		t.Errorf("unexpected cgroupStyle: %v", cgroupStyle)
+	}
+}
+
+func TestRuntimeData(t *testing.T) {
+	testCases := []struct {
+		entry       string
+		cgroupStyle int
+	}{
+		{"testdata/cgroup-crio", CRIOCGroup},
+		{"testdata/cgroup-crio-conmon", CRIOConmonCGroup},
+		{"testdata/cgroup-containerd", ContainerdCGroup},
+		{"testdata/cgroup-cgroupfs", CgroupfsCGroup},
+		{"testdata/cgroup-cgroupfs-guaranteed", CgroupfsCGroup},
+	}
+	for _, tc := range testCases {
+		containerID, cgroupStyle := parseProcCGroupEntry(tc.entry)
+		if containerID != "3e8f9a1b2c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f" {
+			t.Errorf("%s: unexpected containerID: %v", tc.entry, containerID)
+		}
+		if cgroupStyle != tc.cgroupStyle {
+			t.Errorf("%s: unexpected cgroupStyle: %v", tc.entry, cgroupStyle)
+		}
+	}
+}
+
+func TestConmonIsNotContainer(t *testing.T) {
+	if isContainerCGroup(CRIOConmonCGroup) {
+		t.Errorf("conmon cgroup unexpectedly reported as container")
+	}
+}
+
+func TestCgroupfsPodData(t *testing.T) {
+	containerID, cgroupStyle := parseProcCGroupLine("11:pids:/kubepods/burstable/pod6a6a9b3d-5e8a-4a1c-9c4e-2b4f0c8d1e77")
+	if containerID != "pod6a6a9b3d-5e8a-4a1c-9c4e-2b4f0c8d1e77" {
+		t.Errorf("unexpected containerID: %v", containerID)
+	}
+	if cgroupStyle != PodCGroup {
+		t.Errorf("unexpected cgroupStyle: %v", cgroupStyle)
+	}
+}
+
+func TestRegisterCGroupParser(t *testing.T) {
+	saved := CGroupParsers
+	defer func() { CGroupParsers = saved }()
+
+	RegisterCGroupParser(NewScopeCGroupParser("test", "test-", UnknownCGroup+1000, true))
+	containerID, cgroupStyle := parseProcCGroupLine("0::/kubepods.slice/test-abcdef.scope")
+	if containerID != "abcdef" {
+		t.Errorf("unexpected containerID: %v", containerID)
+	}
+	if cgroupStyle != UnknownCGroup+1000 {
+		t.Errorf("unexpected cgroupStyle: %v", cgroupStyle)
+	}
+
+	procDir, err := ioutil.TempDir("", "cgroupparser")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(procDir)
+	err = os.MkdirAll(filepath.Join(procDir, "42"), 0755)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	entry := "12:pids:/kubepods.slice/kubepods-pod1234.slice\n0::/kubepods.slice/test-abcdef.scope\n"
+	err = ioutil.WriteFile(filepath.Join(procDir, "42", "cgroup"), []byte(entry), 0644)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	containerID, cgroupStyle = FindContainerIDByCGroup(procDir, 42)
+	if containerID != "abcdef" {
+		t.Errorf("unexpected containerID: %v", containerID)
+	}
+	if cgroupStyle != UnknownCGroup+1000 {
+		t.Errorf("unexpected cgroupStyle: %v", cgroupStyle)
+	}
+
+	cpf := &CRIPodFinder{
+		ProcDir: procDir,
+		containerInfos: map[string]containerInfo{
+			"abcdef": {PodSandboxID: "sandbox", Name: "compute"},
+		},
+		podInfos: map[string]PodMeta{
+			"sandbox": {Namespace: "default", Name: "virt-launcher-testvm", UID: "1234", Domain: "testvm"},
+		},
+	}
+	podMeta, err := cpf.FindPodByPID(42)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if podMeta.Name != "virt-launcher-testvm" || podMeta.Container != "compute" {
+		t.Errorf("unexpected pod: %#v", podMeta)
+	}
+}
@@ -22,6 +22,8 @@ package processes
 import (
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/shirou/gopsutil/process"
@@ -33,10 +35,16 @@ import (
 )
 
 var labels = []string{
-	"host",    // On which host is the domain running?
-	"domain",  // Which domain the process belongs to?
-	"process", // What's the process?
-	"type",    // what are we measuring?
+	"host",      // On which host is the domain running?
+	"domain",    // Which domain the process belongs to?
+	"process",   // What's the process?
+	"type",      // what are we measuring?
+	"namespace", // Which namespace the pod belongs to?
+	"pod",       // Which pod the process belongs to?
+	"pod_uid",   // Which pod, unambiguously, the process belongs to?
+	"container", // Which container the process belongs to?
+	"vmi",       // Which VMI the pod runs, if any?
+	"qos_class", // Which QoS class the pod belongs to?
 }
 
 var (
@@ -55,23 +63,126 @@ var (
 			},
 		},
 	)
-	cpuTimesDesc = prometheus.NewDesc(
-		"kubevirt_pod_infra_cpu_seconds_total",
-		"CPU time spent, seconds.",
-		labels,
+	criInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "kubevirt",
+			Subsystem: "pod_infra",
+			Name:      "cri_info",
+			Help:      "CRI runtime information and negotiated CRI API version.",
+		},
+		[]string{"runtime", "runtime_version", "api_version"},
+	)
+	criUpDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_cri_up",
+		"Whether the collector is connected to the CRI runtime (1) or not (0).",
+		nil,
 		nil,
 	)
-	memoryAmountDesc = prometheus.NewDesc(
-		"kubevirt_pod_infra_memory_amount_bytes",
+	cpuTimes = newProcessMetric(
+		"CPU time spent, seconds.",
+		schemaName{"kubevirt_pod_infra_cpu_seconds_total", prometheus.GaugeValue},
+		schemaName{"kubevirt_pod_infra_process_cpu_seconds_total", prometheus.CounterValue},
+		"mode",
+	)
+	threadCPUTimes = newProcessMetric(
+		"CPU time spent by the live threads, seconds. Decreases when threads exit.",
+		schemaName{"kubevirt_pod_infra_thread_cpu_seconds", prometheus.GaugeValue},
+		schemaName{"kubevirt_pod_infra_process_thread_cpu_seconds", prometheus.GaugeValue},
+		"mode", "thread_class", "vcpu",
+	)
+	schedTime = newProcessMetric(
+		"Time spent by the threads running on a cpu or waiting on a runqueue, seconds.",
+		schemaName{"kubevirt_pod_infra_sched_seconds_total", prometheus.CounterValue},
+		schemaName{"kubevirt_pod_infra_process_sched_seconds_total", prometheus.CounterValue},
+		"state", "thread_class",
+	)
+	schedTimeslices = newProcessMetric(
+		"Timeslices run on a cpu by the threads.",
+		schemaName{"kubevirt_pod_infra_sched_timeslices_total", prometheus.CounterValue},
+		schemaName{"kubevirt_pod_infra_process_sched_timeslices_total", prometheus.CounterValue},
+		"", "thread_class",
+	)
+	// a histogram: the value type is not used
+	schedRunDelay = newProcessMetric(
+		"Timeslices by the average time their thread spent waiting on a runqueue per timeslice, seconds.",
+		schemaName{"kubevirt_pod_infra_sched_run_delay_seconds", prometheus.UntypedValue},
+		schemaName{"kubevirt_pod_infra_process_sched_run_delay_seconds", prometheus.UntypedValue},
+		"", "thread_class",
+	)
+	ioBytes = newProcessMetric(
+		"Bytes read from or written to the storage layer, bytes.",
+		schemaName{"kubevirt_pod_infra_io_bytes_total", prometheus.CounterValue},
+		schemaName{"kubevirt_pod_infra_process_io_bytes_total", prometheus.CounterValue},
+		"operation",
+	)
+	ioSyscalls = newProcessMetric(
+		"Read-like and write-like syscalls.",
+		schemaName{"kubevirt_pod_infra_io_syscalls_total", prometheus.CounterValue},
+		schemaName{"kubevirt_pod_infra_process_io_syscalls_total", prometheus.CounterValue},
+		"operation",
+	)
+	ksmBytes = newProcessMetric(
+		"Memory merged and saved by KSM, bytes.",
+		schemaName{"kubevirt_pod_infra_ksm_bytes", prometheus.GaugeValue},
+		schemaName{"kubevirt_pod_infra_process_ksm_bytes", prometheus.GaugeValue},
+		"kind",
+	)
+	numaMemory = newProcessMetric(
+		"Memory allocated on each NUMA node, bytes.",
+		schemaName{"kubevirt_pod_infra_numa_memory_bytes", prometheus.GaugeValue},
+		schemaName{"kubevirt_pod_infra_process_numa_memory_bytes", prometheus.GaugeValue},
+		"", "numa_node",
+	)
+	numaInfo = newProcessMetric(
+		"CPUs and NUMA nodes the process is allowed to use.",
+		schemaName{"kubevirt_pod_infra_numa_info", prometheus.GaugeValue},
+		schemaName{"kubevirt_pod_infra_process_numa_info", prometheus.GaugeValue},
+		"", "cpus", "mems",
+	)
+	processThreads = newProcessMetric(
+		"Threads of the process in each scheduling state.",
+		schemaName{"kubevirt_pod_infra_process_threads", prometheus.GaugeValue},
+		schemaName{"kubevirt_pod_infra_process_threads", prometheus.GaugeValue},
+		"state",
+	)
+	processStuck = newProcessMetric(
+		"Whether any thread of the process is in uninterruptible sleep for longer than the threshold (1) or not (0).",
+		schemaName{"kubevirt_pod_infra_process_stuck", prometheus.GaugeValue},
+		schemaName{"kubevirt_pod_infra_process_stuck", prometheus.GaugeValue},
+		"",
+	)
+	threadStuck = newProcessMetric(
+		"Time spent in uninterruptible sleep by the stuck threads, seconds.",
+		schemaName{"kubevirt_pod_infra_thread_stuck_seconds", prometheus.GaugeValue},
+		schemaName{"kubevirt_pod_infra_process_thread_stuck_seconds", prometheus.GaugeValue},
+		"", "tid", "wchan",
+	)
+	// v1 reports all the memory amounts in one metric; v2 follows the prometheus client process metrics
+	virtualMemory = newProcessMetric(
 		"Memory amount, bytes.",
-		labels,
-		nil,
+		schemaName{"kubevirt_pod_infra_memory_amount_bytes", prometheus.GaugeValue},
+		schemaName{"kubevirt_pod_infra_process_virtual_memory_bytes", prometheus.GaugeValue},
+		"",
+	)
+	residentMemory = newProcessMetric(
+		"Memory amount, bytes.",
+		schemaName{"kubevirt_pod_infra_memory_amount_bytes", prometheus.GaugeValue},
+		schemaName{"kubevirt_pod_infra_process_resident_memory_bytes", prometheus.GaugeValue},
+		"",
+	)
+	memoryAmount = newProcessMetric(
+		"Memory amount, bytes.",
+		schemaName{"kubevirt_pod_infra_memory_amount_bytes", prometheus.GaugeValue},
+		schemaName{"kubevirt_pod_infra_process_memory_bytes", prometheus.GaugeValue},
+		"kind",
 	)
 )
 
 type Collector struct {
-	conf *Config
-	mon  Monitor
+	conf          *Config
+	mon           Monitor
+	finder        PodFinder // nil for the SelfCollector
+	podCollectors []podCollector
 }
 
 func NewSelfCollector() (*Collector, error) {
@@ -92,7 +203,7 @@ func NewCollectorFromConf(conf *Config) (*Collector, error) {
 		Targets: conf.Targets,
 	}
 
-	finder, err := NewCRIPodFinder(conf.CRIEndPoint, DefaultTimeout, scanner)
+	finder, err := NewPodFinderFromConf(conf, scanner)
 	if err != nil {
 		return nil, err
 	}
@@ -101,143 +212,481 @@ func NewCollectorFromConf(conf *Config) (*Collector, error) {
 	if err != nil {
 		return nil, err
 	}
+	mon.Options = SampleOptions{
+		Threads:       conf.ThreadMetrics == ThreadMetricsClass || conf.ThreadMetrics == ThreadMetricsVCPU,
+		SchedStats:    conf.SchedStats,
+		MemoryDetails: conf.MemoryDetails,
+		KSM:           conf.KSM,
+		NUMA:          conf.NUMA,
+		States:        conf.ProcessStates,
+	}
+	mon.HungThreshold = conf.HungThreshold.Duration
 
-	return &Collector{
-		conf: conf,
-		mon:  mon,
-	}, nil
+	co := &Collector{
+		conf:   conf,
+		mon:    mon,
+		finder: finder,
+	}
+	if conf.QMP {
+		qc := NewQMPCollector(conf)
+		mon.addRefresher(qc)
+		co.podCollectors = append(co.podCollectors, qc)
+	}
+	if conf.GuestAgent {
+		gc := NewGuestAgentCollector(conf)
+		mon.addRefresher(gc)
+		co.podCollectors = append(co.podCollectors, gc)
+	}
+	if conf.KSM {
+		co.podCollectors = append(co.podCollectors, NewNodeKSMCollector(conf))
+	}
+	if conf.PinningCheck {
+		co.podCollectors = append(co.podCollectors, NewPinningChecker(conf))
+	}
+	if conf.Interval.Duration > 0 {
+		mon.Start(conf.Interval.Duration)
+	}
+	return co, nil
+}
+
+// NewPodFinderFromConf creates the PodFinder selected in the given Config
+func NewPodFinderFromConf(conf *Config, scanner procscanner.ProcScanner) (PodFinder, error) {
+	if conf.PodFinder == CGroupPodFinderName {
+		return NewCGroupPodFinder(conf.PodLogsDir, scanner)
+	}
+	return NewCRIPodFinder(conf.CRIEndPoint, DefaultTimeout, scanner)
+}
+
+// Close stops the background activities of the Collector and releases its resources.
+// The Collector cannot be used anymore once closed.
+func (co *Collector) Close() error {
+	if dm, ok := co.mon.(*DomainMonitor); ok {
+		dm.Stop()
+	}
+	if co.finder == nil {
+		return nil
+	}
+	return co.finder.Close()
 }
 
 func (co Collector) Describe(ch chan<- *prometheus.Desc) {
 	prometheus.DescribeByCollect(co, ch)
 }
 
+// collectCRIUp reports whether the CRIPodFinder, if in use, is connected to the runtime.
+// No pod can be found while it is not, so this is reported even if the update fails.
+func (co Collector) collectCRIUp(ch chan<- prometheus.Metric) {
+	cpf, ok := co.finder.(*CRIPodFinder)
+	if !ok {
+		return
+	}
+	up := 0.0
+	if cpf.Connected() {
+		up = 1.0
+	}
+	m, err := prometheus.NewConstMetric(criUpDesc, prometheus.GaugeValue, up)
+	if err != nil {
+		log.Log.Warningf("failed to update the CRI status: %v", err)
+		return
+	}
+	ch <- m
+}
+
 // Note that Collect could be called concurrently
 func (co Collector) Collect(ch chan<- prometheus.Metric) {
+	start := time.Now()
+	defer func() {
+		scrapeDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	co.collectCRIUp(ch)
+
 	pods, err := co.mon.Update()
 	if err != nil {
-		// TODO: log
+		log.Log.Warningf("failed to update the pods: %v", err)
+		countError(StageUpdate, err)
 		return
 	}
 
 	updated := 0
 	for podName, podInfo := range pods {
-		for _, proc := range podInfo.Procs {
-			err = co.collectCPU(ch, podName, proc)
+		for _, sample := range podInfo.Samples {
+			err = co.collectCPU(ch, podInfo.Meta, sample)
 			if err != nil {
 				log.Log.Warningf("failed to update CPU for pod %v: %v", podName, err)
+				countError(StageCollect, err)
 				continue
 			}
 
-			err = co.collectMemory(ch, podName, proc)
+			err = co.collectMemory(ch, podInfo.Meta, sample)
 			if err != nil {
 				log.Log.Warningf("failed to update Memory for pod %v: %v", podName, err)
+				countError(StageCollect, err)
+				continue
+			}
+
+			err = co.collectKSM(ch, podInfo.Meta, sample)
+			if err != nil {
+				log.Log.Warningf("failed to update KSM for pod %v: %v", podName, err)
+				countError(StageCollect, err)
+				continue
+			}
+
+			err = co.collectNUMA(ch, podInfo.Meta, sample)
+			if err != nil {
+				log.Log.Warningf("failed to update NUMA for pod %v: %v", podName, err)
+				countError(StageCollect, err)
+				continue
+			}
+
+			err = co.collectState(ch, podInfo.Meta, sample)
+			if err != nil {
+				log.Log.Warningf("failed to update process state for pod %v: %v", podName, err)
+				countError(StageCollect, err)
+				continue
+			}
+
+			err = co.collectIO(ch, podInfo.Meta, sample)
+			if err != nil {
+				log.Log.Warningf("failed to update I/O for pod %v: %v", podName, err)
+				countError(StageCollect, err)
+				continue
+			}
+
+			err = co.collectThreads(ch, podInfo.Meta, sample)
+			if err != nil {
+				log.Log.Warningf("failed to update threads for pod %v: %v", podName, err)
+				countError(StageCollect, err)
+				continue
+			}
+
+			err = co.collectSchedStat(ch, podInfo.Meta, sample)
+			if err != nil {
+				log.Log.Warningf("failed to update scheduler stats for pod %v: %v", podName, err)
+				countError(StageCollect, err)
 				continue
 			}
 			updated++
 		}
 	}
 	log.Log.V(2).Infof("updated metrics for %v pods", updated)
+
+	for _, pc := range co.podCollectors {
+		pc.collectPods(ch, pods)
+	}
+}
+
+// labelValues returns the values matching labels for the given process and measurement type
+func (co *Collector) labelValues(meta PodMeta, sample *ProcSample, measure string) []string {
+	return []string{
+		co.conf.Hostname, meta.Domain, sample.Name, measure,
+		meta.Namespace, meta.Name, meta.UID, meta.Container, meta.VMI, meta.QOSClass,
+	}
 }
 
-func (co *Collector) collectCPU(ch chan<- prometheus.Metric, domain string, proc *process.Process) error {
-	process, err := extractProcName(proc)
+func (co *Collector) collectCPU(ch chan<- prometheus.Metric, meta PodMeta, sample *ProcSample) error {
+	times := sample.Times
+
+	m, err := co.newProcessMetric(cpuTimes, times.User, meta, sample, "user")
 	if err != nil {
 		return err
 	}
+	ch <- m
 
-	times, err := proc.Times()
+	m, err = co.newProcessMetric(cpuTimes, times.System, meta, sample, "system")
 	if err != nil {
 		return err
 	}
+	ch <- m
 
-	m, err := prometheus.NewConstMetric(
-		cpuTimesDesc, prometheus.GaugeValue,
-		times.User,
-		co.conf.Hostname, domain, process, "user",
-	)
+	return nil
+}
+
+func (co *Collector) collectMemory(ch chan<- prometheus.Metric, meta PodMeta, sample *ProcSample) error {
+	memInfo := sample.MemInfo
+
+	m, err := co.newProcessMetric(virtualMemory, float64(memInfo.VMS), meta, sample, "virtual")
 	if err != nil {
 		return err
 	}
 	ch <- m
 
-	m, err = prometheus.NewConstMetric(
-		cpuTimesDesc, prometheus.GaugeValue,
-		times.System,
-		co.conf.Hostname, domain, process, "system",
-	)
+	m, err = co.newProcessMetric(residentMemory, float64(memInfo.RSS), meta, sample, "resident")
 	if err != nil {
 		return err
 	}
 	ch <- m
 
-	return nil
-}
-
-func (co *Collector) collectMemory(ch chan<- prometheus.Metric, domain string, proc *process.Process) error {
-	process, err := extractProcName(proc)
+	m, err = co.newProcessMetric(memoryAmount, float64(memInfo.Shared), meta, sample, "shared")
 	if err != nil {
 		return err
 	}
+	ch <- m
 
-	memInfo, err := proc.MemoryInfoEx()
+	m, err = co.newProcessMetric(memoryAmount, float64(memInfo.Dirty), meta, sample, "dirty")
 	if err != nil {
 		return err
 	}
+	ch <- m
 
-	m, err := prometheus.NewConstMetric(
-		memoryAmountDesc, prometheus.GaugeValue,
-		float64(memInfo.VMS),
-		co.conf.Hostname, domain, process, "virtual",
-	)
+	return co.collectMemoryDetails(ch, meta, sample)
+}
+
+func (co *Collector) collectMemoryDetails(ch chan<- prometheus.Metric, meta PodMeta, sample *ProcSample) error {
+	md := sample.MemDetail
+	if md == nil {
+		return nil
+	}
+
+	measures := []struct {
+		value   uint64
+		measure string
+		rollup  bool
+	}{
+		{md.Anonymous, "anonymous", false},
+		{md.File, "file", false},
+		{md.HugeTLB, "hugetlb", false},
+		{md.Locked, "locked", false},
+		{md.Pinned, "pinned", false},
+		{md.PSS, "pss", true},
+		{md.Swap, "swap", true},
+		{md.AnonHugePages, "anon_hugepages", true},
+	}
+	for _, ms := range measures {
+		if ms.rollup && !md.Rollup {
+			continue
+		}
+		m, err := co.newProcessMetric(memoryAmount, float64(ms.value), meta, sample, ms.measure)
+		if err != nil {
+			return err
+		}
+		ch <- m
+	}
+	return nil
+}
+
+func (co *Collector) collectKSM(ch chan<- prometheus.Metric, meta PodMeta, sample *ProcSample) error {
+	if sample.KSM == nil {
+		return nil
+	}
+
+	measure := "merging"
+	if sample.KSM.Estimated {
+		measure = "shared_anonymous"
+	}
+	m, err := co.newProcessMetric(ksmBytes, float64(sample.KSM.Merging), meta, sample, measure)
 	if err != nil {
 		return err
 	}
 	ch <- m
 
-	m, err = prometheus.NewConstMetric(
-		memoryAmountDesc, prometheus.GaugeValue,
-		float64(memInfo.RSS),
-		co.conf.Hostname, domain, process, "resident",
-	)
+	if !sample.KSM.HasProfit {
+		return nil
+	}
+	m, err = co.newProcessMetric(ksmBytes, float64(sample.KSM.Profit), meta, sample, "profit")
 	if err != nil {
 		return err
 	}
 	ch <- m
+	return nil
+}
 
-	m, err = prometheus.NewConstMetric(
-		memoryAmountDesc, prometheus.GaugeValue,
-		float64(memInfo.Shared),
-		co.conf.Hostname, domain, process, "shared",
-	)
+func (co *Collector) collectNUMA(ch chan<- prometheus.Metric, meta PodMeta, sample *ProcSample) error {
+	if sample.NUMA == nil {
+		return nil
+	}
+
+	for node, amount := range sample.NUMA.Memory {
+		m, err := co.newProcessMetric(numaMemory, float64(amount), meta, sample, "resident", strconv.Itoa(node))
+		if err != nil {
+			return err
+		}
+		ch <- m
+	}
+
+	m, err := co.newProcessMetric(numaInfo, 1, meta, sample, "allowed", sample.NUMA.CPUsAllowed, sample.NUMA.MemsAllowed)
 	if err != nil {
 		return err
 	}
 	ch <- m
+	return nil
+}
 
-	m, err = prometheus.NewConstMetric(
-		memoryAmountDesc, prometheus.GaugeValue,
-		float64(memInfo.Dirty),
-		co.conf.Hostname, domain, process, "dirty",
-	)
+func (co *Collector) collectState(ch chan<- prometheus.Metric, meta PodMeta, sample *ProcSample) error {
+	if sample.State == nil {
+		return nil
+	}
+
+	counts := make(map[string]int)
+	for _, th := range sample.State.Threads {
+		counts[th.State]++
+	}
+	for state, count := range counts {
+		m, err := co.newProcessMetric(processThreads, float64(count), meta, sample, state)
+		if err != nil {
+			return err
+		}
+		ch <- m
+	}
+
+	stuck := 0.0
+	if sample.State.Stuck() {
+		stuck = 1.0
+	}
+	m, err := co.newProcessMetric(processStuck, stuck, meta, sample, DiskSleepState)
 	if err != nil {
 		return err
 	}
 	ch <- m
 
+	for _, th := range sample.State.Threads {
+		if !th.Stuck {
+			continue
+		}
+		m, err = co.newProcessMetric(threadStuck, sample.Timestamp.Sub(th.DiskSleepSince).Seconds(), meta, sample, DiskSleepState, strconv.Itoa(int(th.TID)), th.WChan)
+		if err != nil {
+			return err
+		}
+		ch <- m
+	}
 	return nil
 }
 
+func (co *Collector) collectIO(ch chan<- prometheus.Metric, meta PodMeta, sample *ProcSample) error {
+	if sample.IO == nil {
+		return nil
+	}
+
+	measures := []struct {
+		metric  *processMetric
+		value   uint64
+		measure string
+	}{
+		{ioBytes, sample.IO.ReadBytes, "read"},
+		{ioBytes, sample.IO.WriteBytes, "write"},
+		{ioBytes, sample.IO.CancelledWriteBytes, "cancelled_write"},
+		{ioSyscalls, sample.IO.ReadSyscalls, "read"},
+		{ioSyscalls, sample.IO.WriteSyscalls, "write"},
+	}
+	for _, ms := range measures {
+		m, err := co.newProcessMetric(ms.metric, float64(ms.value), meta, sample, ms.measure)
+		if err != nil {
+			return err
+		}
+		ch <- m
+	}
+	return nil
+}
+
+// threadGroup is the CPU time of the threads of a process with the same class - and vCPU index, if any.
+type threadGroup struct {
+	Class  string
+	VCPU   string
+	User   float64
+	System float64
+}
+
+// groupThreads aggregates the given threads according to the ThreadMetrics detail level
+func groupThreads(threads []ThreadSample, level string) []*threadGroup {
+	groups := []*threadGroup{}
+	index := make(map[string]*threadGroup)
+	for _, th := range threads {
+		vcpu := ""
+		if level == ThreadMetricsVCPU && th.Class == VCPUThread {
+			vcpu = strconv.Itoa(th.VCPU)
+		}
+		key := th.Class + "/" + vcpu
+		group, ok := index[key]
+		if !ok {
+			group = &threadGroup{
+				Class: th.Class,
+				VCPU:  vcpu,
+			}
+			index[key] = group
+			groups = append(groups, group)
+		}
+		group.User += th.User
+		group.System += th.System
+	}
+	return groups
+}
+
+func (co *Collector) collectThreads(ch chan<- prometheus.Metric, meta PodMeta, sample *ProcSample) error {
+	for _, group := range groupThreads(sample.Threads, co.conf.ThreadMetrics) {
+		m, err := co.newProcessMetric(threadCPUTimes, group.User, meta, sample, "user", group.Class, group.VCPU)
+		if err != nil {
+			return err
+		}
+		ch <- m
+
+		m, err = co.newProcessMetric(threadCPUTimes, group.System, meta, sample, "system", group.Class, group.VCPU)
+		if err != nil {
+			return err
+		}
+		ch <- m
+	}
+	return nil
+}
+
+func (co *Collector) collectSchedStat(ch chan<- prometheus.Metric, meta PodMeta, sample *ProcSample) error {
+	if sample.Sched == nil {
+		return nil
+	}
+
+	for _, cs := range sample.Sched.Classes {
+		m, err := co.newProcessMetric(schedTime, cs.RunTime, meta, sample, "running", cs.Class)
+		if err != nil {
+			return err
+		}
+		ch <- m
+
+		m, err = co.newProcessMetric(schedTime, cs.WaitTime, meta, sample, "waiting", cs.Class)
+		if err != nil {
+			return err
+		}
+		ch <- m
+
+		m, err = co.newProcessMetric(schedTimeslices, float64(cs.Timeslices), meta, sample, "running", cs.Class)
+		if err != nil {
+			return err
+		}
+		ch <- m
+
+		desc, _, values := co.processMetricDesc(schedRunDelay, meta, sample, "waiting", cs.Class)
+		m, err = prometheus.NewConstHistogram(desc, cs.Timeslices, cs.WaitTime, cs.Buckets(), values...)
+		if err != nil {
+			return err
+		}
+		ch <- m
+	}
+	return nil
+}
+
+// VhostProcessName is the process name of all the vhost kernel threads
+const VhostProcessName = "vhost"
+
 func extractProcName(proc *process.Process) (string, error) {
 	cmdline, err := proc.CmdlineSlice()
-	if err != nil || len(cmdline) < 1 {
+	if err != nil {
 		return "", err
 	}
+	if len(cmdline) < 1 {
+		// kernel threads have no command line
+		comm, err := proc.Name()
+		if err != nil {
+			return "", err
+		}
+		if _, ok := procscanner.ParseVhostName(comm); ok {
+			return VhostProcessName, nil
+		}
+		return comm, nil
+	}
 	return filepath.Base(cmdline[0]), nil
 }
 
 func init() {
 	prometheus.MustRegister(version)
+	prometheus.MustRegister(criInfo)
 
 	version.Set(1)
 }
@@ -0,0 +1,210 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/internal/pkg/log"
+	"github.com/fromanirh/kubevirt-metrics-collector/pkg/qmp"
+)
+
+var (
+	guestAgentUpDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_vm_guest_agent_up",
+		"Whether the guest agent of the VM answered (1) or not (0).",
+		vmLabels,
+		nil,
+	)
+	guestOSInfoDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_vm_guest_os_info",
+		"Guest OS information, as reported by the guest agent.",
+		append(vmLabels, "os_id", "os_name", "os_version_id", "kernel_release", "machine"),
+		nil,
+	)
+	guestFilesystemDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_vm_guest_filesystem_bytes",
+		"Size and usage of the guest filesystems, as reported by the guest agent, bytes.",
+		append(vmLabels, "mountpoint", "fstype", "type"),
+		nil,
+	)
+	guestAgentUnreachableVMsDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_guest_agent_unreachable_vms",
+		"VMs with only the libvirt guest agent channel, whose agent cannot be queried.",
+		[]string{"host"},
+		nil,
+	)
+)
+
+// GuestAgentCollector exports the information the qemu guest agent reports about the guest.
+// The sockets of the agent channels dedicated to the metrics are found in the qemu command line,
+// and reached through /proc/PID/root. Like the QMPCollector, the agents are queried when the
+// DomainMonitor refreshes the pods; collectPods just exports the latest results.
+type GuestAgentCollector struct {
+	ProcDir        string
+	Timeout        time.Duration // for each agent call
+	hostname       string
+	cache          metricsCache
+	noChannelsOnce sync.Once
+}
+
+func NewGuestAgentCollector(conf *Config) *GuestAgentCollector {
+	return &GuestAgentCollector{
+		ProcDir:  DefaultProcDir,
+		Timeout:  DefaultQMPTimeout,
+		hostname: conf.Hostname,
+	}
+}
+
+func (gc *GuestAgentCollector) vmLabelValues(meta PodMeta) []string {
+	return []string{
+		gc.hostname, meta.Domain, meta.Namespace, meta.Name, meta.UID, meta.VMI,
+	}
+}
+
+func (gc *GuestAgentCollector) collectPods(ch chan<- prometheus.Metric, pods PodInfoMap) {
+	gc.cache.collect(ch)
+}
+
+func (gc *GuestAgentCollector) refreshPods(pods PodInfoMap) {
+	gc.cache.update(func(ch chan<- prometheus.Metric) {
+		gc.queryPods(ch, pods)
+	})
+}
+
+// queryPods queries the guest agents of all the VMs of the given pods
+func (gc *GuestAgentCollector) queryPods(ch chan<- prometheus.Metric, pods PodInfoMap) {
+	unreachable := 0
+	findSockets := func(pid int32) []string {
+		argv := readCmdline(gc.ProcDir, pid)
+		sockets := qmp.AgentSockets(argv)
+		if len(sockets) == 0 && qmp.HasAgentChannel(argv, qmp.GuestAgentChannel) {
+			unreachable++
+		}
+		return sockets
+	}
+	queryVMs(pods, findSockets, func(podName string, meta PodMeta, pid int32, sockets []string) {
+		up := 0.0
+		agent, err := gc.dial(pid, sockets)
+		if err != nil {
+			// most likely the agent is not running in the guest: not worth a warning
+			log.Log.V(3).Infof("failed to connect to the guest agent of pid %v for pod %v: %v", pid, podName, err)
+		} else {
+			up = 1.0
+			err = gc.collectGuest(ch, meta, agent)
+			if err != nil {
+				log.Log.Warningf("failed to update guest info for pod %v: %v", podName, err)
+			}
+			agent.Close()
+		}
+
+		m, err := prometheus.NewConstMetric(
+			guestAgentUpDesc, prometheus.GaugeValue,
+			up,
+			gc.vmLabelValues(meta)...,
+		)
+		if err != nil {
+			log.Log.Warningf("failed to update guest agent status for pod %v: %v", podName, err)
+			return
+		}
+		ch <- m
+	})
+
+	// stock VMs have only the libvirt channel: tell why their guest metrics are missing
+	m, err := prometheus.NewConstMetric(
+		guestAgentUnreachableVMsDesc, prometheus.GaugeValue,
+		float64(unreachable),
+		gc.hostname,
+	)
+	if err != nil {
+		log.Log.Warningf("failed to update the unreachable guest agents: %v", err)
+	} else {
+		ch <- m
+	}
+	if unreachable > 0 {
+		gc.noChannelsOnce.Do(func() {
+			log.Log.Warningf("%v VMs have only the libvirt guest agent channel %s, which the collector cannot share: add a %s channel to collect their guest metrics",
+				unreachable, qmp.GuestAgentChannel, qmp.MetricsAgentChannel)
+		})
+	}
+}
+
+// dial connects to the first agent which answers
+func (gc *GuestAgentCollector) dial(pid int32, sockets []string) (*qmp.Agent, error) {
+	var err error
+	for _, socket := range sockets {
+		var agent *qmp.Agent
+		agent, err = qmp.DialAgent(procRootPath(gc.ProcDir, pid, socket), gc.Timeout)
+		if err == nil {
+			return agent, nil
+		}
+		log.Log.V(4).Infof("failed to connect to the guest agent on %v for pid %v: %v", socket, pid, err)
+	}
+	return nil, err
+}
+
+func (gc *GuestAgentCollector) collectGuest(ch chan<- prometheus.Metric, meta PodMeta, agent *qmp.Agent) error {
+	info, err := agent.OSInfo()
+	if err != nil {
+		return err
+	}
+	m, err := prometheus.NewConstMetric(
+		guestOSInfoDesc, prometheus.GaugeValue,
+		1,
+		append(gc.vmLabelValues(meta), info.ID, info.Name, info.VersionID, info.KernelRelease, info.Machine)...,
+	)
+	if err != nil {
+		return err
+	}
+	ch <- m
+
+	fss, err := agent.FSInfo()
+	if err != nil {
+		return err
+	}
+	for _, fs := range fss {
+		if fs.TotalBytes == nil || fs.UsedBytes == nil {
+			continue // old agent
+		}
+		m, err = prometheus.NewConstMetric(
+			guestFilesystemDesc, prometheus.GaugeValue,
+			float64(*fs.TotalBytes),
+			append(gc.vmLabelValues(meta), fs.MountPoint, fs.Type, "total")...,
+		)
+		if err != nil {
+			return err
+		}
+		ch <- m
+
+		m, err = prometheus.NewConstMetric(
+			guestFilesystemDesc, prometheus.GaugeValue,
+			float64(*fs.UsedBytes),
+			append(gc.vmLabelValues(meta), fs.MountPoint, fs.Type, "used")...,
+		)
+		if err != nil {
+			return err
+		}
+		ch <- m
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/pkg/qmp/qmptest"
+)
+
+func agentArgs(socket string) []string {
+	return []string{
+		"-chardev", "socket,id=metricsagent,path=" + socket + ",server=on,wait=off",
+		"-device", "virtserialport,bus=virtio-serial0.0,nr=2,chardev=metricsagent,name=org.qemu.guest_agent.metrics",
+	}
+}
+
+func TestGuestAgentCollector(t *testing.T) {
+	srv, err := qmptest.NewAgentServer()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	defer srv.Close()
+	srv.Returns["guest-get-osinfo"] = map[string]interface{}{
+		"id":             "fedora",
+		"name":           "Fedora",
+		"version-id":     "30",
+		"kernel-release": "5.0.9-301.fc30.x86_64",
+		"machine":        "x86_64",
+	}
+	srv.Returns["guest-get-fsinfo"] = []map[string]interface{}{
+		{"name": "vda1", "mountpoint": "/", "type": "xfs", "used-bytes": 1073741824, "total-bytes": 4294967296},
+		{"name": "vdb", "mountpoint": "/data", "type": "ext4"},
+	}
+
+	pid := int32(os.Getpid())
+	procDir := fakeQEMUProcDir(t, pid, agentArgs(srv.Path())...)
+	defer os.RemoveAll(procDir)
+
+	gc := NewGuestAgentCollector(NewConfig())
+	gc.ProcDir = procDir
+	gc.Timeout = time.Second
+	values := collectMetrics(t, gc, fakeQEMUPods(t, pid))
+
+	expected := map[string]float64{
+		"kubevirt_pod_infra_vm_guest_agent_up{}":                                                 1,
+		"kubevirt_pod_infra_vm_guest_os_info{kernel_release=5.0.9-301.fc30.x86_64,os_id=fedora}": 1,
+		"kubevirt_pod_infra_vm_guest_filesystem_bytes{mountpoint=/,type=total}":                  4294967296,
+		"kubevirt_pod_infra_vm_guest_filesystem_bytes{mountpoint=/,type=used}":                   1073741824,
+		"kubevirt_pod_infra_guest_agent_unreachable_vms{}":                                       0,
+	}
+	for key, value := range expected {
+		got, ok := values[key]
+		if !ok || got != value {
+			t.Errorf("unexpected value for %v: %v (found=%v)", key, got, ok)
+		}
+	}
+	if len(values) != len(expected) {
+		t.Errorf("unexpected values: %#v", values)
+	}
+}
+
+func TestGuestAgentCollectorSkipsLibvirtChannel(t *testing.T) {
+	srv, err := qmptest.NewAgentServer()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	defer srv.Close()
+
+	pid := int32(os.Getpid())
+	procDir := fakeQEMUProcDir(t, pid,
+		"-chardev", "socket,id=charchannel0,path="+srv.Path()+",server,nowait",
+		"-device", "virtserialport,bus=virtio-serial0.0,nr=1,chardev=charchannel0,id=channel0,name=org.qemu.guest_agent.0",
+	)
+	defer os.RemoveAll(procDir)
+
+	gc := NewGuestAgentCollector(NewConfig())
+	gc.ProcDir = procDir
+	values := collectMetrics(t, gc, fakeQEMUPods(t, pid))
+
+	if len(values) != 1 || values["kubevirt_pod_infra_guest_agent_unreachable_vms{}"] != 1 {
+		t.Errorf("unexpected values: %#v", values)
+	}
+}
+
+func TestGuestAgentCollectorCollectsCachedResults(t *testing.T) {
+	pid := int32(os.Getpid())
+	procDir := fakeQEMUProcDir(t, pid, agentArgs("/inexistent/metrics-agent.sock")...)
+	defer os.RemoveAll(procDir)
+
+	gc := NewGuestAgentCollector(NewConfig())
+	gc.ProcDir = procDir
+	pods := fakeQEMUPods(t, pid)
+
+	// nothing is queried while collecting
+	ch := make(chan prometheus.Metric, 16)
+	gc.collectPods(ch, pods)
+	if len(ch) != 0 {
+		t.Errorf("unexpected metrics before the first refresh: %v", len(ch))
+		return
+	}
+	gc.refreshPods(pods)
+	gc.collectPods(ch, pods)
+	// the agent status and the unreachable agents
+	if len(ch) != 2 {
+		t.Errorf("unexpected cached metrics: %v", len(ch))
+	}
+}
+
+func TestGuestAgentCollectorNotRunning(t *testing.T) {
+	pid := int32(os.Getpid())
+	procDir := fakeQEMUProcDir(t, pid, agentArgs("/inexistent/org.qemu.guest_agent.0")...)
+	defer os.RemoveAll(procDir)
+
+	gc := NewGuestAgentCollector(NewConfig())
+	gc.ProcDir = procDir
+	gc.Timeout = time.Second
+	values := collectMetrics(t, gc, fakeQEMUPods(t, pid))
+
+	if len(values) != 2 || values["kubevirt_pod_infra_vm_guest_agent_up{}"] != 0 {
+		t.Errorf("unexpected values: %#v", values)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/internal/pkg/log"
+)
+
+var (
+	nodeKSMRunningDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_node_ksm_running",
+		"Whether KSM is running (1) or not (0) on the node.",
+		[]string{"host"},
+		nil,
+	)
+	nodeKSMBytesDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_node_ksm_bytes",
+		"Memory shared, sharing, unshared and volatile, as accounted by KSM on the node, bytes.",
+		[]string{"host", "type"},
+		nil,
+	)
+	nodeKSMFullScansDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_node_ksm_full_scans_total",
+		"Full scans of the mergeable memory done by KSM on the node.",
+		[]string{"host"},
+		nil,
+	)
+)
+
+// NodeKSMCollector exports the node-wide KSM accounting. It does not depend on the pods: the
+// values are read from sysfs on each Collect, so they may be more recent than the per-process
+// ones, which are sampled by the DomainMonitor.
+type NodeKSMCollector struct {
+	SysDir   string
+	hostname string
+}
+
+func NewNodeKSMCollector(conf *Config) *NodeKSMCollector {
+	return &NodeKSMCollector{
+		SysDir:   DefaultSysDir,
+		hostname: conf.Hostname,
+	}
+}
+
+func (nc *NodeKSMCollector) collectPods(ch chan<- prometheus.Metric, pods PodInfoMap) {
+	err := nc.collectNode(ch)
+	if err != nil {
+		log.Log.Warningf("failed to update node KSM: %v", err)
+	}
+}
+
+func (nc *NodeKSMCollector) collectNode(ch chan<- prometheus.Metric) error {
+	ns, err := SampleNodeKSM(nc.SysDir)
+	if err != nil || ns == nil {
+		return err
+	}
+
+	running := 0.0
+	if ns.Running {
+		running = 1.0
+	}
+	m, err := prometheus.NewConstMetric(
+		nodeKSMRunningDesc, prometheus.GaugeValue,
+		running,
+		nc.hostname,
+	)
+	if err != nil {
+		return err
+	}
+	ch <- m
+
+	measures := []struct {
+		pages   uint64
+		measure string
+	}{
+		{ns.PagesShared, "shared"},
+		{ns.PagesSharing, "sharing"},
+		{ns.PagesUnshared, "unshared"},
+		{ns.PagesVolatile, "volatile"},
+	}
+	for _, ms := range measures {
+		m, err = prometheus.NewConstMetric(
+			nodeKSMBytesDesc, prometheus.GaugeValue,
+			float64(ms.pages*ns.PageSize),
+			nc.hostname, ms.measure,
+		)
+		if err != nil {
+			return err
+		}
+		ch <- m
+	}
+
+	m, err = prometheus.NewConstMetric(
+		nodeKSMFullScansDesc, prometheus.CounterValue,
+		float64(ns.FullScans),
+		nc.hostname,
+	)
+	if err != nil {
+		return err
+	}
+	ch <- m
+	return nil
+}
@@ -0,0 +1,447 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/internal/pkg/log"
+	"github.com/fromanirh/kubevirt-metrics-collector/pkg/qmp"
+)
+
+// vmLabels are the labels of the per-VM metrics: unlike the per-process ones, there is no process to report.
+var vmLabels = []string{
+	"host",
+	"domain",
+	"namespace",
+	"pod",
+	"pod_uid",
+	"vmi",
+}
+
+var (
+	qmpUpDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_vm_qmp_up",
+		"Whether the QMP monitor of the VM answered (1) or not (0).",
+		vmLabels,
+		nil,
+	)
+	blockBytesDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_vm_block_bytes_total",
+		"Bytes read from or written to a drive of the VM, bytes.",
+		append(vmLabels, "drive", "type"),
+		nil,
+	)
+	blockOperationsDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_vm_block_operations_total",
+		"Read, write and flush operations on a drive of the VM.",
+		append(vmLabels, "drive", "type"),
+		nil,
+	)
+	blockTimeDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_vm_block_time_seconds_total",
+		"Time spent on read, write and flush operations on a drive of the VM, seconds.",
+		append(vmLabels, "drive", "type"),
+		nil,
+	)
+	balloonBytesDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_vm_balloon_bytes",
+		"Memory currently assigned to the VM by the balloon, bytes.",
+		vmLabels,
+		nil,
+	)
+	migrationInProgressDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_vm_migration_in_progress",
+		"Whether the VM is being migrated away (1) or not (0).",
+		vmLabels,
+		nil,
+	)
+	migrationMemoryDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_vm_migration_memory_bytes",
+		"Guest memory transferred, remaining to transfer and total, bytes.",
+		append(vmLabels, "type"),
+		nil,
+	)
+	migrationDirtyRateDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_vm_migration_dirty_memory_rate_bytes",
+		"Rate at which the guest dirties its memory during the migration, bytes per second.",
+		vmLabels,
+		nil,
+	)
+	migrationExpectedDowntimeDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_vm_migration_expected_downtime_seconds",
+		"Downtime expected if the migration switched over now, seconds.",
+		vmLabels,
+		nil,
+	)
+	migrationIterationsDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_vm_migration_iterations",
+		"Passes over the guest memory done by the migration so far.",
+		vmLabels,
+		nil,
+	)
+	vmStatDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_vm_stat",
+		"Statistics reported by qemu's query-stats, per VM or per vCPU.",
+		append(vmLabels, "provider", "vcpu", "stat"),
+		nil,
+	)
+)
+
+// DefaultQMPTimeout bounds each QMP call: a VM which does not answer promptly must not stall the refresh of the others
+const DefaultQMPTimeout = 1 * time.Second
+
+// podCollector exports metrics about the pods found by the Monitor, besides the per-process ones.
+type podCollector interface {
+	collectPods(ch chan<- prometheus.Metric, pods PodInfoMap)
+}
+
+// metricsCache holds the metrics gathered by a podRefresher, to be exported by its collectPods
+type metricsCache struct {
+	lock    sync.Mutex
+	metrics []prometheus.Metric
+}
+
+// update replaces the cached metrics with the ones the given function sends
+func (mc *metricsCache) update(gather func(ch chan<- prometheus.Metric)) {
+	ch := make(chan prometheus.Metric)
+	done := make(chan []prometheus.Metric)
+	go func() {
+		var metrics []prometheus.Metric
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		done <- metrics
+	}()
+	gather(ch)
+	close(ch)
+	metrics := <-done
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.metrics = metrics
+}
+
+// collect sends the cached metrics
+func (mc *metricsCache) collect(ch chan<- prometheus.Metric) {
+	mc.lock.Lock()
+	metrics := mc.metrics
+	mc.lock.Unlock()
+	for _, m := range metrics {
+		ch <- m
+	}
+}
+
+// QMPCollector exports the per-VM statistics qemu reports on its QMP monitor sockets.
+// The sockets are found in the qemu command line, and reached through /proc/PID/root.
+// The VMs are queried when the DomainMonitor refreshes the pods; collectPods just exports the latest results.
+type QMPCollector struct {
+	ProcDir  string
+	Timeout  time.Duration // for each QMP call
+	hostname string
+	cache    metricsCache
+}
+
+func NewQMPCollector(conf *Config) *QMPCollector {
+	return &QMPCollector{
+		ProcDir:  DefaultProcDir,
+		Timeout:  DefaultQMPTimeout,
+		hostname: conf.Hostname,
+	}
+}
+
+func (qc *QMPCollector) vmLabelValues(meta PodMeta) []string {
+	return []string{
+		qc.hostname, meta.Domain, meta.Namespace, meta.Name, meta.UID, meta.VMI,
+	}
+}
+
+func (qc *QMPCollector) collectPods(ch chan<- prometheus.Metric, pods PodInfoMap) {
+	qc.cache.collect(ch)
+}
+
+func (qc *QMPCollector) refreshPods(pods PodInfoMap) {
+	qc.cache.update(func(ch chan<- prometheus.Metric) {
+		qc.queryPods(ch, pods)
+	})
+}
+
+// queryPods queries all the VMs of the given pods
+func (qc *QMPCollector) queryPods(ch chan<- prometheus.Metric, pods PodInfoMap) {
+	queryVMs(pods, qc.monitorSockets, func(podName string, meta PodMeta, pid int32, sockets []string) {
+		up := 0.0
+		client, err := qc.dial(pid, sockets)
+		if err != nil {
+			log.Log.Warningf("failed to connect to QMP of pid %v for pod %v: %v", pid, podName, err)
+		} else {
+			up = 1.0
+			err = qc.collectVM(ch, meta, client)
+			if err != nil {
+				log.Log.Warningf("failed to update QMP stats for pod %v: %v", podName, err)
+			}
+			client.Close()
+		}
+
+		m, err := prometheus.NewConstMetric(
+			qmpUpDesc, prometheus.GaugeValue,
+			up,
+			qc.vmLabelValues(meta)...,
+		)
+		if err != nil {
+			log.Log.Warningf("failed to update QMP status for pod %v: %v", podName, err)
+			return
+		}
+		ch <- m
+	})
+}
+
+// queryVMs runs the given query on each process of the given pods which has sockets to query.
+// The processes are queried concurrently, so an unresponsive VM does not delay the others.
+func queryVMs(pods PodInfoMap, findSockets func(pid int32) []string, query func(podName string, meta PodMeta, pid int32, sockets []string)) {
+	var wg sync.WaitGroup
+	for podName, podInfo := range pods {
+		for _, proc := range podInfo.Procs {
+			sockets := findSockets(proc.Pid)
+			if len(sockets) == 0 {
+				continue // not qemu, or not reachable anyway
+			}
+			wg.Add(1)
+			go func(podName string, meta PodMeta, pid int32) {
+				defer wg.Done()
+				query(podName, meta, pid, sockets)
+			}(podName, podInfo.Meta, proc.Pid)
+		}
+	}
+	wg.Wait()
+}
+
+// monitorSockets returns the QMP sockets of the given process, if any
+func (qc *QMPCollector) monitorSockets(pid int32) []string {
+	return qmp.MonitorSockets(readCmdline(qc.ProcDir, pid))
+}
+
+// dial connects to the first socket which answers
+func (qc *QMPCollector) dial(pid int32, sockets []string) (*qmp.Client, error) {
+	var err error
+	for _, socket := range sockets {
+		var client *qmp.Client
+		client, err = qmp.Dial(procRootPath(qc.ProcDir, pid, socket), qc.Timeout)
+		if err == nil {
+			return client, nil
+		}
+		log.Log.V(4).Infof("failed to connect to QMP on %v for pid %v: %v", socket, pid, err)
+	}
+	return nil, err
+}
+
+// readCmdline returns the command line of the given process, or nil if it is gone
+func readCmdline(procDir string, pid int32) []string {
+	content, err := ioutil.ReadFile(filepath.Join(procDir, strconv.Itoa(int(pid)), "cmdline"))
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimRight(string(content), "\x00"), "\x00")
+}
+
+// procRootPath translates the given path to the mount namespace of the given process
+func procRootPath(procDir string, pid int32, path string) string {
+	return filepath.Join(procDir, strconv.Itoa(int(pid)), "root", path)
+}
+
+func (qc *QMPCollector) collectVM(ch chan<- prometheus.Metric, meta PodMeta, client *qmp.Client) error {
+	err := qc.collectBlockStats(ch, meta, client)
+	if err != nil {
+		return err
+	}
+
+	err = qc.collectBalloon(ch, meta, client)
+	if err != nil {
+		return err
+	}
+
+	err = qc.collectMigration(ch, meta, client)
+	if err != nil {
+		return err
+	}
+
+	return qc.collectStats(ch, meta, client)
+}
+
+func (qc *QMPCollector) collectBlockStats(ch chan<- prometheus.Metric, meta PodMeta, client *qmp.Client) error {
+	blockStats, err := client.QueryBlockStats()
+	if err != nil {
+		return err
+	}
+
+	for _, bs := range blockStats {
+		drive := bs.Name()
+		measures := []struct {
+			desc    *prometheus.Desc
+			value   float64
+			measure string
+		}{
+			{blockBytesDesc, float64(bs.Stats.ReadBytes), "read"},
+			{blockBytesDesc, float64(bs.Stats.WriteBytes), "write"},
+			{blockOperationsDesc, float64(bs.Stats.ReadOperations), "read"},
+			{blockOperationsDesc, float64(bs.Stats.WriteOperations), "write"},
+			{blockOperationsDesc, float64(bs.Stats.FlushOperations), "flush"},
+			{blockTimeDesc, float64(bs.Stats.ReadTotalTimeNS) / 1e9, "read"},
+			{blockTimeDesc, float64(bs.Stats.WriteTotalTimeNS) / 1e9, "write"},
+			{blockTimeDesc, float64(bs.Stats.FlushTotalTimeNS) / 1e9, "flush"},
+		}
+		for _, ms := range measures {
+			m, err := prometheus.NewConstMetric(
+				ms.desc, prometheus.CounterValue,
+				ms.value,
+				append(qc.vmLabelValues(meta), drive, ms.measure)...,
+			)
+			if err != nil {
+				return err
+			}
+			ch <- m
+		}
+	}
+	return nil
+}
+
+func (qc *QMPCollector) collectBalloon(ch chan<- prometheus.Metric, meta PodMeta, client *qmp.Client) error {
+	info, err := client.QueryBalloon()
+	if qmpErr, ok := err.(*qmp.Error); ok && qmpErr.Class == "DeviceNotActive" {
+		return nil // no balloon configured
+	}
+	if err != nil {
+		return err
+	}
+
+	m, err := prometheus.NewConstMetric(
+		balloonBytesDesc, prometheus.GaugeValue,
+		float64(info.Actual),
+		qc.vmLabelValues(meta)...,
+	)
+	if err != nil {
+		return err
+	}
+	ch <- m
+	return nil
+}
+
+func (qc *QMPCollector) collectMigration(ch chan<- prometheus.Metric, meta PodMeta, client *qmp.Client) error {
+	info, err := client.QueryMigrate()
+	if err != nil {
+		return err
+	}
+
+	inProgress := 0.0
+	if info.InProgress() {
+		inProgress = 1.0
+	}
+	m, err := prometheus.NewConstMetric(
+		migrationInProgressDesc, prometheus.GaugeValue,
+		inProgress,
+		qc.vmLabelValues(meta)...,
+	)
+	if err != nil {
+		return err
+	}
+	ch <- m
+
+	// the stats of completed or failed migrations linger until the next one, but they are just noise
+	if !info.InProgress() || info.RAM == nil {
+		return nil
+	}
+
+	measures := []struct {
+		desc    *prometheus.Desc
+		value   float64
+		measure string
+	}{
+		{migrationMemoryDesc, float64(info.RAM.Transferred), "transferred"},
+		{migrationMemoryDesc, float64(info.RAM.Remaining), "remaining"},
+		{migrationMemoryDesc, float64(info.RAM.Total), "total"},
+		{migrationDirtyRateDesc, info.RAM.DirtyPagesRate * float64(info.RAM.PageSize), ""},
+		{migrationExpectedDowntimeDesc, float64(info.ExpectedDowntime) / 1000, ""},
+		{migrationIterationsDesc, float64(info.RAM.DirtySyncCount), ""},
+	}
+	for _, ms := range measures {
+		labelValues := qc.vmLabelValues(meta)
+		if ms.measure != "" {
+			labelValues = append(labelValues, ms.measure)
+		}
+		m, err := prometheus.NewConstMetric(
+			ms.desc, prometheus.GaugeValue,
+			ms.value,
+			labelValues...,
+		)
+		if err != nil {
+			return err
+		}
+		ch <- m
+	}
+	return nil
+}
+
+func (qc *QMPCollector) collectStats(ch chan<- prometheus.Metric, meta PodMeta, client *qmp.Client) error {
+	// the vCPUs are identified by QOM path in the query-stats output
+	vcpus := make(map[string]string)
+	cpus, err := client.QueryCPUsFast()
+	if err != nil {
+		log.Log.V(4).Infof("failed to query the vCPUs: %v", err)
+	}
+	for _, cpu := range cpus {
+		vcpus[cpu.QOMPath] = strconv.Itoa(cpu.CPUIndex)
+	}
+
+	for _, target := range []string{qmp.StatsTargetVM, qmp.StatsTargetVCPU} {
+		results, err := client.QueryStats(target)
+		if qmpErr, ok := err.(*qmp.Error); ok && qmpErr.Class == "CommandNotFound" {
+			log.Log.V(4).Infof("query-stats not supported by qemu %v", client.Version)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, res := range results {
+			vcpu := vcpus[res.QOMPath]
+			for _, stat := range res.Stats {
+				if stat.Value == nil {
+					continue
+				}
+				m, err := prometheus.NewConstMetric(
+					vmStatDesc, prometheus.GaugeValue,
+					*stat.Value,
+					append(qc.vmLabelValues(meta), res.Provider, vcpu, stat.Name)...,
+				)
+				if err != nil {
+					return err
+				}
+				ch <- m
+			}
+		}
+	}
+	return nil
+}
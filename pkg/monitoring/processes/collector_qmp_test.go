@@ -0,0 +1,400 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/shirou/gopsutil/process"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/pkg/qmp"
+	"github.com/fromanirh/kubevirt-metrics-collector/pkg/qmp/qmptest"
+)
+
+// fakeQEMUProcDir creates a procfs-like tree in which the given pid is a qemu with the given arguments
+func fakeQEMUProcDir(t *testing.T, pid int32, args ...string) string {
+	procDir, err := ioutil.TempDir("", "qmpproc")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	addFakeQEMU(t, procDir, pid, args...)
+	return procDir
+}
+
+// addFakeQEMU adds to the given procfs-like tree the given pid, as a qemu with the given arguments
+func addFakeQEMU(t *testing.T, procDir string, pid int32, args ...string) {
+	pidDir := filepath.Join(procDir, strconv.Itoa(int(pid)))
+	err := os.MkdirAll(pidDir, 0755)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	argv := append([]string{"/usr/libexec/qemu-kvm"}, args...)
+	err = ioutil.WriteFile(filepath.Join(pidDir, "cmdline"), []byte(strings.Join(argv, "\x00")+"\x00"), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = os.Symlink("/", filepath.Join(pidDir, "root"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func fakeQEMUPods(t *testing.T, pid int32) PodInfoMap {
+	proc, err := process.NewProcess(pid)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return PodInfoMap{
+		"vm": &PodInfo{
+			Meta: PodMeta{
+				Namespace: "default",
+				Name:      "virt-launcher-testvmi-x7k2p",
+				UID:       "6a6a9b3d",
+				Container: "compute",
+				VMI:       "testvmi",
+				Domain:    "testvmi",
+			},
+			Procs: []*process.Process{proc},
+		},
+	}
+}
+
+// collectMetrics refreshes and runs the given podCollector, and returns the values of the metrics, by name and labels
+func collectMetrics(t *testing.T, pc podCollector, pods PodInfoMap) map[string]float64 {
+	if pr, ok := pc.(podRefresher); ok {
+		pr.refreshPods(pods)
+	}
+	ch := make(chan prometheus.Metric, 1024)
+	pc.collectPods(ch, pods)
+	close(ch)
+
+	ret := make(map[string]float64)
+	for m := range ch {
+		var pb dto.Metric
+		err := m.Write(&pb)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		desc := m.Desc().String()
+		// Desc{fqName: "kubevirt_pod_infra_...", ...}
+		name := strings.Split(desc, "\"")[1]
+		var labels []string
+		for _, lp := range pb.Label {
+			switch lp.GetName() {
+			case "drive", "type", "vcpu", "stat", "provider", "mountpoint", "os_id", "kernel_release":
+				labels = append(labels, lp.GetName()+"="+lp.GetValue())
+			}
+		}
+		key := name + "{" + strings.Join(labels, ",") + "}"
+		switch {
+		case pb.Gauge != nil:
+			ret[key] = pb.Gauge.GetValue()
+		case pb.Counter != nil:
+			ret[key] = pb.Counter.GetValue()
+		}
+	}
+	return ret
+}
+
+func TestQMPCollector(t *testing.T) {
+	srv, err := qmptest.NewServer()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	defer srv.Close()
+	srv.Returns["query-blockstats"] = []map[string]interface{}{
+		{
+			"device": "",
+			"qdev":   "/machine/peripheral/virtio-disk0/virtio-backend",
+			"stats": map[string]interface{}{
+				"rd_bytes":         4096,
+				"wr_bytes":         8192,
+				"flush_operations": 3,
+				"wr_total_time_ns": 1500000000,
+			},
+		},
+	}
+	srv.Errors["query-balloon"] = &qmp.Error{Class: "DeviceNotActive", Desc: "No balloon device has been activated"}
+	srv.Returns["query-cpus-fast"] = []map[string]interface{}{
+		{"cpu-index": 0, "qom-path": "/machine/unattached/device[0]", "thread-id": 4250},
+		{"cpu-index": 1, "qom-path": "/machine/unattached/device[1]", "thread-id": 4251},
+	}
+	srv.Returns["query-migrate"] = map[string]interface{}{
+		"status":            "active",
+		"expected-downtime": 300,
+		"ram": map[string]interface{}{
+			"transferred":      1073741824,
+			"remaining":        536870912,
+			"total":            2147483648,
+			"dirty-pages-rate": 2500,
+			"dirty-sync-count": 3,
+			"page-size":        4096,
+		},
+	}
+	srv.Returns["query-stats"] = []map[string]interface{}{
+		{
+			"provider": "kvm",
+			"qom-path": "/machine/unattached/device[1]",
+			"stats": []map[string]interface{}{
+				{"name": "halt_wait_ns", "value": 123456},
+			},
+		},
+	}
+
+	pid := int32(os.Getpid())
+	procDir := fakeQEMUProcDir(t, pid, "-qmp", "unix:"+srv.Path()+",server,nowait")
+	defer os.RemoveAll(procDir)
+
+	qc := NewQMPCollector(NewConfig())
+	qc.ProcDir = procDir
+	qc.Timeout = time.Second
+	values := collectMetrics(t, qc, fakeQEMUPods(t, pid))
+
+	expected := map[string]float64{
+		"kubevirt_pod_infra_vm_qmp_up{}":                                                1,
+		"kubevirt_pod_infra_vm_block_bytes_total{drive=virtio-disk0,type=read}":         4096,
+		"kubevirt_pod_infra_vm_block_bytes_total{drive=virtio-disk0,type=write}":        8192,
+		"kubevirt_pod_infra_vm_block_operations_total{drive=virtio-disk0,type=flush}":   3,
+		"kubevirt_pod_infra_vm_block_time_seconds_total{drive=virtio-disk0,type=write}": 1.5,
+		"kubevirt_pod_infra_vm_migration_in_progress{}":                                 1,
+		"kubevirt_pod_infra_vm_migration_memory_bytes{type=remaining}":                  536870912,
+		"kubevirt_pod_infra_vm_migration_dirty_memory_rate_bytes{}":                     2500 * 4096,
+		"kubevirt_pod_infra_vm_migration_expected_downtime_seconds{}":                   0.3,
+		"kubevirt_pod_infra_vm_migration_iterations{}":                                  3,
+		// the vm target and the vcpu target get the same answer from the fake server
+		"kubevirt_pod_infra_vm_stat{provider=kvm,stat=halt_wait_ns,vcpu=1}": 123456,
+	}
+	for key, value := range expected {
+		got, ok := values[key]
+		if !ok || got != value {
+			t.Errorf("unexpected value for %v: %v (found=%v)", key, got, ok)
+		}
+	}
+	if _, ok := values["kubevirt_pod_infra_vm_balloon_bytes{}"]; ok {
+		t.Errorf("unexpected balloon metric")
+	}
+}
+
+func TestQMPCollectorMigrationCompleted(t *testing.T) {
+	srv, err := qmptest.NewServer()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	defer srv.Close()
+	srv.Returns["query-blockstats"] = []interface{}{}
+	srv.Returns["query-balloon"] = map[string]interface{}{"actual": 1073741824}
+	srv.Returns["query-migrate"] = map[string]interface{}{
+		"status": "completed",
+		"ram": map[string]interface{}{
+			"transferred": 2147483648,
+			"remaining":   0,
+			"total":       2147483648,
+		},
+	}
+	srv.Returns["query-stats"] = []interface{}{}
+
+	pid := int32(os.Getpid())
+	procDir := fakeQEMUProcDir(t, pid, "-qmp", "unix:"+srv.Path()+",server,nowait")
+	defer os.RemoveAll(procDir)
+
+	qc := NewQMPCollector(NewConfig())
+	qc.ProcDir = procDir
+	qc.Timeout = time.Second
+	values := collectMetrics(t, qc, fakeQEMUPods(t, pid))
+
+	if values["kubevirt_pod_infra_vm_migration_in_progress{}"] != 0 {
+		t.Errorf("unexpected migration in progress: %#v", values)
+	}
+	if _, ok := values["kubevirt_pod_infra_vm_migration_memory_bytes{type=remaining}"]; ok {
+		t.Errorf("unexpected migration details: %#v", values)
+	}
+	if values["kubevirt_pod_infra_vm_balloon_bytes{}"] != 1073741824 {
+		t.Errorf("unexpected balloon: %#v", values)
+	}
+}
+
+func TestQMPCollectorUnreachable(t *testing.T) {
+	pid := int32(os.Getpid())
+	procDir := fakeQEMUProcDir(t, pid, "-qmp", "unix:/inexistent/qmp.sock,server,nowait")
+	defer os.RemoveAll(procDir)
+
+	qc := NewQMPCollector(NewConfig())
+	qc.ProcDir = procDir
+	qc.Timeout = time.Second
+	values := collectMetrics(t, qc, fakeQEMUPods(t, pid))
+
+	if len(values) != 1 || values["kubevirt_pod_infra_vm_qmp_up{}"] != 0 {
+		t.Errorf("unexpected values: %#v", values)
+	}
+}
+
+func TestQMPCollectorCollectsCachedResults(t *testing.T) {
+	srv, err := qmptest.NewServer()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	defer srv.Close()
+	srv.Returns["query-blockstats"] = []interface{}{}
+	srv.Returns["query-migrate"] = map[string]interface{}{"status": "none"}
+	srv.Returns["query-stats"] = []interface{}{}
+
+	pid := int32(os.Getpid())
+	procDir := fakeQEMUProcDir(t, pid, "-qmp", "unix:"+srv.Path()+",server,nowait")
+	defer os.RemoveAll(procDir)
+
+	qc := NewQMPCollector(NewConfig())
+	qc.ProcDir = procDir
+	pods := fakeQEMUPods(t, pid)
+
+	// nothing is queried while collecting
+	ch := make(chan prometheus.Metric, 1024)
+	qc.collectPods(ch, pods)
+	if len(ch) != 0 {
+		t.Errorf("unexpected metrics before the first refresh: %v", len(ch))
+		return
+	}
+
+	qc.refreshPods(pods)
+	srv.Close()
+	for i := 0; i < 2; i++ {
+		qc.collectPods(ch, pods)
+	}
+	close(ch)
+	up := 0
+	for m := range ch {
+		if strings.Contains(m.Desc().String(), `"kubevirt_pod_infra_vm_qmp_up"`) {
+			up++
+		}
+	}
+	if up != 2 {
+		t.Errorf("unexpected cached results: %v", up)
+	}
+}
+
+func TestQMPCollectorSkipsLibvirtMonitor(t *testing.T) {
+	srv, err := qmptest.NewServer()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	defer srv.Close()
+
+	pid := int32(os.Getpid())
+	procDir := fakeQEMUProcDir(t, pid,
+		"-chardev", "socket,id=charmonitor,path="+srv.Path()+",server=on,wait=off",
+		"-mon", "chardev=charmonitor,id=monitor,mode=control",
+	)
+	defer os.RemoveAll(procDir)
+
+	qc := NewQMPCollector(NewConfig())
+	qc.ProcDir = procDir
+	values := collectMetrics(t, qc, fakeQEMUPods(t, pid))
+
+	if len(values) != 0 {
+		t.Errorf("unexpected values: %#v", values)
+	}
+}
+
+// hungSocket accepts the connections on a unix socket in the given directory, and never answers
+func hungSocket(t *testing.T, dir string) (net.Listener, string) {
+	path := filepath.Join(dir, "hung.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return l, path
+}
+
+func TestQMPCollectorQueriesVMsConcurrently(t *testing.T) {
+	procDir, err := ioutil.TempDir("", "qmpproc")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(procDir)
+	l, path := hungSocket(t, procDir)
+	defer l.Close()
+
+	// the processes are used only for their PIDs
+	pods := make(PodInfoMap)
+	for _, pid := range []int32{4901, 4902, 4903} {
+		addFakeQEMU(t, procDir, pid, "-qmp", "unix:"+path+",server,nowait")
+		proc, err := process.NewProcess(int32(os.Getpid()))
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		proc.Pid = pid
+		pods[strconv.Itoa(int(pid))] = &PodInfo{
+			Meta:  PodMeta{UID: strconv.Itoa(int(pid)), Domain: strconv.Itoa(int(pid))},
+			Procs: []*process.Process{proc},
+		}
+	}
+
+	qc := NewQMPCollector(NewConfig())
+	qc.ProcDir = procDir
+	qc.Timeout = 300 * time.Millisecond
+	start := time.Now()
+	values := collectMetrics(t, qc, pods)
+	// one after another, the unresponsive VMs would take 3 timeouts
+	if elapsed := time.Since(start); elapsed > 2*qc.Timeout {
+		t.Errorf("unexpected refresh time: %v", elapsed)
+	}
+	if len(values) != 1 || values["kubevirt_pod_infra_vm_qmp_up{}"] != 0 {
+		t.Errorf("unexpected values: %#v", values)
+	}
+}
+
+func TestQMPCollectorNotQEMU(t *testing.T) {
+	qc := NewQMPCollector(NewConfig())
+	qc.ProcDir = "testdata/proc"
+	values := collectMetrics(t, qc, fakeQEMUPods(t, int32(os.Getpid())))
+
+	if len(values) != 0 {
+		t.Errorf("unexpected values: %#v", values)
+	}
+}
@@ -27,6 +27,23 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
+)
+
+// PodFinder implementations selectable in the Config
+const (
+	CRIPodFinderName    = "cri"
+	CGroupPodFinderName = "cgroup"
+)
+
+// DefaultHungThreshold is how long a thread can be in uninterruptible sleep before being reported as stuck
+const DefaultHungThreshold = 60 * time.Second
+
+// Per-thread metrics detail levels
+const (
+	ThreadMetricsNone  = "none"  // no per-thread metrics
+	ThreadMetricsClass = "class" // aggregate the threads by class
+	ThreadMetricsVCPU  = "vcpu"  // like ThreadMetricsClass, but report each vCPU thread separately
 )
 
 // Config encodes the configuration of the monitoring package
@@ -36,6 +53,41 @@ type Config struct {
 	CRIEndPoint   string                   `json:"criendpoint"`
 	Hostname      string                   `json:"hostname"`
 	DebugMode     bool                     `json:"debugmode"`
+	PodFinder     string                   `json:"podfinder"`
+	PodLogsDir    string                   `json:"podlogsdir"`
+	Interval      Duration                 `json:"interval"` // zero means sample at each scrape
+	ThreadMetrics string                   `json:"threadmetrics"`
+	SchedStats    bool                     `json:"schedstats"`
+	MemoryDetails bool                     `json:"memorydetails"`
+	QMP           bool                     `json:"qmp"`
+	GuestAgent    bool                     `json:"guestagent"`
+	KSM           bool                     `json:"ksm"`
+	NUMA          bool                     `json:"numa"`
+	PinningCheck  bool                     `json:"pinningcheck"`
+	ProcessStates bool                     `json:"processstates"`
+	HungThreshold Duration                 `json:"hungthreshold"` // only with ProcessStates
+	MetricsSchema string                   `json:"metricsschema"`
+}
+
+// Duration is a time.Duration which can be encoded in JSON as string, like "5s"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
 }
 
 // NewConfig creates a new Config object with the current defaults
@@ -65,8 +117,45 @@ func (c *Config) Validate() error {
 	if c.ListenAddress == "" {
 		return errors.New("missing listen address")
 	}
-	if c.CRIEndPoint == "" {
-		return errors.New("missing CRI endpoint")
+	if c.Interval.Duration < 0 {
+		return fmt.Errorf("invalid sampling interval: %v", c.Interval.Duration)
+	}
+	if c.HungThreshold.Duration < 0 {
+		return fmt.Errorf("invalid hung threshold: %v", c.HungThreshold.Duration)
+	}
+	if c.ProcessStates && c.HungThreshold.Duration == 0 {
+		c.HungThreshold.Duration = DefaultHungThreshold
+	}
+	if c.ThreadMetrics == "" {
+		c.ThreadMetrics = ThreadMetricsNone
+	}
+	switch c.ThreadMetrics {
+	case ThreadMetricsNone, ThreadMetricsClass, ThreadMetricsVCPU:
+	default:
+		return fmt.Errorf("unknown thread metrics level: '%s'", c.ThreadMetrics)
+	}
+	if c.MetricsSchema == "" {
+		c.MetricsSchema = MetricsSchemaV1
+	}
+	switch c.MetricsSchema {
+	case MetricsSchemaV1, MetricsSchemaV2:
+	default:
+		return fmt.Errorf("unknown metrics schema: '%s'", c.MetricsSchema)
+	}
+	if c.PodFinder == "" {
+		c.PodFinder = CRIPodFinderName
+	}
+	switch c.PodFinder {
+	case CRIPodFinderName:
+		if c.CRIEndPoint == "" {
+			return errors.New("missing CRI endpoint")
+		}
+	case CGroupPodFinderName:
+		if c.PodLogsDir == "" {
+			c.PodLogsDir = DefaultPodLogsDir
+		}
+	default:
+		return fmt.Errorf("unknown pod finder: '%s'", c.PodFinder)
 	}
 	if c.Hostname == "" {
 		var err error
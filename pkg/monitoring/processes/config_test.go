@@ -20,7 +20,9 @@
 package processes
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/fromanirh/kubevirt-metrics-collector/pkg/procscanner"
 )
@@ -128,3 +130,106 @@ func checkInvalid(t *testing.T, conf *Config) {
 		t.Errorf("conf unexpectedly valid: %#v", conf)
 	}
 }
+
+func TestConfigCGroupPodFinderWithoutCRIEndPoint(t *testing.T) {
+	conf := NewConfig()
+	conf.Targets = []procscanner.ProcTarget{
+		{
+			Name: "init",
+			Argv: []string{"/sbin/init"},
+		},
+	}
+	conf.ListenAddress = ":9999"
+	conf.PodFinder = CGroupPodFinderName
+
+	checkValid(t, conf)
+	if conf.PodLogsDir != DefaultPodLogsDir {
+		t.Errorf("unexpected pod logs dir: %v", conf.PodLogsDir)
+	}
+}
+
+func TestConfigInvalidPodFinder(t *testing.T) {
+	conf := NewConfig()
+	conf.Targets = []procscanner.ProcTarget{
+		{
+			Name: "init",
+			Argv: []string{"/sbin/init"},
+		},
+	}
+	conf.ListenAddress = ":9999"
+	conf.CRIEndPoint = "/var/run/cri.sock"
+	conf.PodFinder = "foobar"
+
+	checkInvalid(t, conf)
+}
+
+func TestConfigReadInterval(t *testing.T) {
+	conf, err := NewConfigFromFile("testconf.json")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if conf.Interval.Duration != 5*time.Second {
+		t.Errorf("unexpected interval: %v", conf.Interval)
+	}
+}
+
+func TestConfigInvalidInterval(t *testing.T) {
+	conf := NewConfig()
+	err := json.Unmarshal([]byte(`{"interval": "five seconds"}`), conf)
+	if err == nil {
+		t.Errorf("unexpected success parsing: %#v", conf)
+	}
+}
+
+func TestConfigInvalidThreadMetrics(t *testing.T) {
+	conf := NewConfig()
+	conf.Targets = []procscanner.ProcTarget{
+		{
+			Name: "init",
+			Argv: []string{"/sbin/init"},
+		},
+	}
+	conf.ListenAddress = ":9999"
+	conf.CRIEndPoint = "/var/run/cri.sock"
+	conf.ThreadMetrics = "all"
+
+	checkInvalid(t, conf)
+}
+
+func TestConfigDefaultHungThreshold(t *testing.T) {
+	conf := NewConfig()
+	conf.Targets = []procscanner.ProcTarget{
+		{
+			Name: "init",
+			Argv: []string{"/sbin/init"},
+		},
+	}
+	conf.ListenAddress = ":9999"
+	conf.CRIEndPoint = "/var/run/cri.sock"
+	conf.ProcessStates = true
+
+	err := conf.Validate()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if conf.HungThreshold.Duration != DefaultHungThreshold {
+		t.Errorf("unexpected hung threshold: %v", conf.HungThreshold.Duration)
+	}
+}
+
+func TestConfigInvalidMetricsSchema(t *testing.T) {
+	conf := NewConfig()
+	conf.Targets = []procscanner.ProcTarget{
+		{
+			Name: "init",
+			Argv: []string{"/sbin/init"},
+		},
+	}
+	conf.ListenAddress = ":9999"
+	conf.CRIEndPoint = "/var/run/cri.sock"
+	conf.MetricsSchema = "v3"
+
+	checkInvalid(t, conf)
+}
@@ -0,0 +1,102 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// CRI API versions we can talk
+const (
+	CRIAPIv1       = "v1"
+	CRIAPIv1alpha2 = "v1alpha2"
+)
+
+// criRuntimeClient is the subset of the CRI RuntimeService we need.
+type criRuntimeClient interface {
+	Version(ctx context.Context, in *pb.VersionRequest, opts ...grpc.CallOption) (*pb.VersionResponse, error)
+	ListContainers(ctx context.Context, in *pb.ListContainersRequest, opts ...grpc.CallOption) (*pb.ListContainersResponse, error)
+	ListPodSandbox(ctx context.Context, in *pb.ListPodSandboxRequest, opts ...grpc.CallOption) (*pb.ListPodSandboxResponse, error)
+}
+
+// criV1Client talks the runtime.v1 API.
+// runtime.v1 was forked from runtime.v1alpha2 keeping the same messages and field numbers,
+// so the two are wire-compatible: we reuse the v1alpha2 types and just change the service name.
+type criV1Client struct {
+	cc *grpc.ClientConn
+}
+
+func newCRIV1Client(cc *grpc.ClientConn) criRuntimeClient {
+	return &criV1Client{cc: cc}
+}
+
+func (c *criV1Client) Version(ctx context.Context, in *pb.VersionRequest, opts ...grpc.CallOption) (*pb.VersionResponse, error) {
+	out := new(pb.VersionResponse)
+	err := c.cc.Invoke(ctx, "/runtime.v1.RuntimeService/Version", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *criV1Client) ListContainers(ctx context.Context, in *pb.ListContainersRequest, opts ...grpc.CallOption) (*pb.ListContainersResponse, error) {
+	out := new(pb.ListContainersResponse)
+	err := c.cc.Invoke(ctx, "/runtime.v1.RuntimeService/ListContainers", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *criV1Client) ListPodSandbox(ctx context.Context, in *pb.ListPodSandboxRequest, opts ...grpc.CallOption) (*pb.ListPodSandboxResponse, error) {
+	out := new(pb.ListPodSandboxResponse)
+	err := c.cc.Invoke(ctx, "/runtime.v1.RuntimeService/ListPodSandbox", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// negotiateCRIClient probes the endpoint, preferring runtime.v1 and falling back to runtime.v1alpha2.
+// Returns the client, the negotiated API version and the runtime version information.
+func negotiateCRIClient(ctx context.Context, cc *grpc.ClientConn) (criRuntimeClient, string, *pb.VersionResponse, error) {
+	v1 := newCRIV1Client(cc)
+	ver, err := v1.Version(ctx, &pb.VersionRequest{})
+	if err == nil {
+		return v1, CRIAPIv1, ver, nil
+	}
+	if status.Code(err) != codes.Unimplemented {
+		return nil, "", nil, fmt.Errorf("failed to probe CRI %s API: %v", CRIAPIv1, err)
+	}
+
+	v1alpha2 := pb.NewRuntimeServiceClient(cc)
+	ver, err = v1alpha2.Version(ctx, &pb.VersionRequest{})
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to probe CRI %s API: %v", CRIAPIv1alpha2, err)
+	}
+	return v1alpha2, CRIAPIv1alpha2, ver, nil
+}
@@ -0,0 +1,225 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/pkg/procscanner"
+)
+
+// fakeCRIServer answers the few CRI RuntimeService calls we use, for the given API versions only
+type fakeCRIServer struct {
+	APIVersions []string
+	Containers  []*pb.Container
+	Sandboxes   []*pb.PodSandbox
+	dir         string
+	server      *grpc.Server
+}
+
+func newFakeCRIServer(t *testing.T, apiVersions ...string) *fakeCRIServer {
+	dir, err := ioutil.TempDir("", "fakecri")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fs := &fakeCRIServer{
+		APIVersions: apiVersions,
+		dir:         dir,
+	}
+	fs.Start(t)
+	return fs
+}
+
+func (fs *fakeCRIServer) EndPoint() string {
+	return "unix://" + filepath.Join(fs.dir, "cri.sock")
+}
+
+func (fs *fakeCRIServer) Start(t *testing.T) {
+	sockPath := filepath.Join(fs.dir, "cri.sock")
+	os.Remove(sockPath)
+	lis, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fs.server = grpc.NewServer(grpc.UnknownServiceHandler(fs.handle))
+	go fs.server.Serve(lis)
+}
+
+func (fs *fakeCRIServer) Stop() {
+	fs.server.Stop()
+}
+
+func (fs *fakeCRIServer) Close() {
+	fs.Stop()
+	os.RemoveAll(fs.dir)
+}
+
+func (fs *fakeCRIServer) handle(srv interface{}, stream grpc.ServerStream) error {
+	method, _ := grpc.MethodFromServerStream(stream)
+	// /runtime.$VERSION.RuntimeService/$METHOD
+	items := strings.Split(method, "/")
+	if len(items) != 3 || !fs.supports(strings.TrimSuffix(strings.TrimPrefix(items[1], "runtime."), ".RuntimeService")) {
+		return status.Errorf(codes.Unimplemented, "unknown service %v", method)
+	}
+
+	switch items[2] {
+	case "Version":
+		if err := stream.RecvMsg(&pb.VersionRequest{}); err != nil {
+			return err
+		}
+		return stream.SendMsg(&pb.VersionResponse{
+			Version:           "0.1.0",
+			RuntimeName:       "fake",
+			RuntimeVersion:    "1.2.3",
+			RuntimeApiVersion: items[1],
+		})
+	case "ListContainers":
+		if err := stream.RecvMsg(&pb.ListContainersRequest{}); err != nil {
+			return err
+		}
+		return stream.SendMsg(&pb.ListContainersResponse{Containers: fs.Containers})
+	case "ListPodSandbox":
+		if err := stream.RecvMsg(&pb.ListPodSandboxRequest{}); err != nil {
+			return err
+		}
+		return stream.SendMsg(&pb.ListPodSandboxResponse{Items: fs.Sandboxes})
+	}
+	return status.Errorf(codes.Unimplemented, "unknown method %v", method)
+}
+
+func (fs *fakeCRIServer) supports(apiVersion string) bool {
+	for _, ver := range fs.APIVersions {
+		if ver == apiVersion {
+			return true
+		}
+	}
+	return false
+}
+
+func dialFakeCRIServer(t *testing.T, fs *fakeCRIServer) *grpc.ClientConn {
+	addr, dialer, err := getAddressAndDialer(fs.EndPoint())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Second), grpc.WithDialer(dialer))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return conn
+}
+
+func TestNegotiateCRIv1(t *testing.T) {
+	fs := newFakeCRIServer(t, CRIAPIv1, CRIAPIv1alpha2)
+	defer fs.Close()
+	conn := dialFakeCRIServer(t, fs)
+	defer conn.Close()
+
+	_, apiVersion, ver, err := negotiateCRIClient(context.Background(), conn)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if apiVersion != CRIAPIv1 {
+		t.Errorf("unexpected API version: %v", apiVersion)
+	}
+	if ver.RuntimeName != "fake" {
+		t.Errorf("unexpected runtime: %v", ver.RuntimeName)
+	}
+}
+
+func TestNegotiateCRIv1alpha2Fallback(t *testing.T) {
+	fs := newFakeCRIServer(t, CRIAPIv1alpha2)
+	defer fs.Close()
+	conn := dialFakeCRIServer(t, fs)
+	defer conn.Close()
+
+	_, apiVersion, _, err := negotiateCRIClient(context.Background(), conn)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if apiVersion != CRIAPIv1alpha2 {
+		t.Errorf("unexpected API version: %v", apiVersion)
+	}
+}
+
+func TestNegotiateCRIUnsupported(t *testing.T) {
+	fs := newFakeCRIServer(t)
+	defer fs.Close()
+	conn := dialFakeCRIServer(t, fs)
+	defer conn.Close()
+
+	_, _, _, err := negotiateCRIClient(context.Background(), conn)
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestCRIv1ListContainers(t *testing.T) {
+	fs := newFakeCRIServer(t, CRIAPIv1)
+	fs.Containers = []*pb.Container{
+		{Id: "ctr0", PodSandboxId: "pod0"},
+	}
+	defer fs.Close()
+	conn := dialFakeCRIServer(t, fs)
+	defer conn.Close()
+
+	client, _, _, err := negotiateCRIClient(context.Background(), conn)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	r, err := client.ListContainers(context.Background(), &pb.ListContainersRequest{})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if len(r.Containers) != 1 || r.Containers[0].PodSandboxId != "pod0" {
+		t.Errorf("unexpected containers: %#v", r.Containers)
+	}
+}
+
+func TestNewCRIPodFinderNegotiates(t *testing.T) {
+	fs := newFakeCRIServer(t, CRIAPIv1alpha2)
+	defer fs.Close()
+
+	cpf, err := NewCRIPodFinder(fs.EndPoint(), time.Second, procscanner.ProcScanner{})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	defer cpf.conn.Close()
+	if cpf.APIVersion != CRIAPIv1alpha2 {
+		t.Errorf("unexpected API version: %v", cpf.APIVersion)
+	}
+}
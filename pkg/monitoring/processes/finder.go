@@ -19,40 +19,98 @@
 
 package processes
 
-import "github.com/shirou/gopsutil/process"
+import (
+	"time"
+
+	"github.com/shirou/gopsutil/process"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/pkg/procscanner"
+)
+
+// DomainAnnotation is set by KubeVirt on the virt-launcher pods, and holds the VMI name
+const DomainAnnotation = "kubevirt.io/domain"
+
+// PodMeta describes the container, and the pod it belongs to, in which processes run
+type PodMeta struct {
+	Namespace string
+	Name      string
+	UID       string
+	Container string
+	VMI       string // empty if the pod does not run a VM
+	Domain    string // the VMI name if known, the pod name otherwise
+	QOSClass  string // empty if unknown
+	Labels    map[string]string
+}
+
+// Key identifies the container in a PodMap
+func (pm PodMeta) Key() string {
+	if pm.UID == "" {
+		return pm.Domain
+	}
+	return pm.UID + "/" + pm.Container
+}
 
 type PodInfo struct {
-	Procs []*process.Process
+	Meta    PodMeta
+	Procs   []*process.Process
+	Samples []*ProcSample // latest measurements of Procs, see SamplePods
 }
 
 type PodFinder interface {
 	FindPods() (map[string]*PodInfo, error)
-	FindPodByPID(pid int32) (string, error)
+	FindPodByPID(pid int32) (PodMeta, error)
+	// Close releases the resources of the PodFinder, e.g. the connection to the runtime
+	Close() error
 }
 
 type PodMap map[string]*PodInfo
 
-func (pods PodMap) MapProcsToPods(pf PodFinder, procs map[string][]int32) (PodMap, error) {
+// scanProcs runs the given scanner, accounting its duration and errors in the self-metrics
+func scanProcs(scanner procscanner.ProcScanner, procDir string) (map[string][]int32, error) {
+	start := time.Now()
+	procs, err := scanner.Scan(procDir)
+	observeStage(StageProcScan, start, err)
+	return procs, err
+}
+
+// MapProcsToPods resolves the pods of the given processes using the given PodFinder.
+// procDir is the path where procfs is mounted (default: /proc), to classify the unresolved processes.
+func (pods PodMap) MapProcsToPods(pf PodFinder, procDir string, procs map[string][]int32) (PodMap, error) {
+	matched := 0
+	unresolved := make(map[string]int)
 	for _, pids := range procs {
 		for _, pid := range pids {
-			podName, err := pf.FindPodByPID(pid)
+			matched++
+			podMeta, err := pf.FindPodByPID(pid)
 			if err != nil {
-				continue // TODO: log
+				_, classifier := FindContainerIDByCGroup(procDir, pid)
+				unresolved[cgroupClassifierName(classifier)]++
+				continue
 			}
 
-			podInfo, ok := pods[podName]
+			podInfo, ok := pods[podMeta.Key()]
 			if !ok {
-				podInfo = &PodInfo{}
-				pods[podName] = podInfo
+				podInfo = &PodInfo{
+					Meta: podMeta,
+				}
+				pods[podMeta.Key()] = podInfo
 			}
 
 			proc, err := process.NewProcess(pid)
 			if err != nil {
-				continue // TODO: log
+				countError(StageResolvePod, err)
+				continue
 			}
 
 			podInfo.Procs = append(podInfo.Procs, proc)
 		}
 	}
+
+	matchedProcesses.Set(float64(matched))
+	resolvedPods.Set(float64(len(pods)))
+	unresolvedPIDs.Reset()
+	for classifier, count := range unresolved {
+		unresolvedPIDs.WithLabelValues(classifier).Set(float64(count))
+	}
 	return pods, nil
 }
@@ -0,0 +1,217 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/internal/pkg/log"
+	"github.com/fromanirh/kubevirt-metrics-collector/pkg/procscanner"
+)
+
+const (
+	// DefaultPodLogsDir is where the kubelet creates one directory per pod,
+	// named <namespace>_<name>_<uid>, holding one directory per container
+	DefaultPodLogsDir = "/var/log/pods"
+	// containerLogsDirName is the sibling of the pod logs directory where the kubelet links
+	// the log of each container as <pod name>_<namespace>_<container name>-<container id>.log
+	containerLogsDirName = "containers"
+
+	virtLauncherPrefix = "virt-launcher-"
+)
+
+// CGroupPodFinder resolves PIDs to pods without talking to the container runtime:
+// the pod UID and QoS class are taken from /proc/PID/cgroup, while the pod and container names are
+// resolved using the directories the kubelet creates in PodLogsDir and ContainerLogsDir.
+type CGroupPodFinder struct {
+	ProcDir          string
+	PodLogsDir       string
+	ContainerLogsDir string
+	podMetas         map[string]PodMeta
+	podContainers    map[string][]string // pod UID -> container names
+	containerNames   map[string]string   // container ID -> container name
+	scanner          procscanner.ProcScanner
+}
+
+func NewCGroupPodFinder(podLogsDir string, scanner procscanner.ProcScanner) (*CGroupPodFinder, error) {
+	if podLogsDir == "" {
+		podLogsDir = DefaultPodLogsDir
+	}
+	log.Log.Infof("resolving pods using cgroups and '%v'", podLogsDir)
+	return &CGroupPodFinder{
+		ProcDir:          DefaultProcDir,
+		PodLogsDir:       podLogsDir,
+		ContainerLogsDir: filepath.Join(filepath.Dir(podLogsDir), containerLogsDirName),
+		scanner:          scanner,
+		podMetas:         make(map[string]PodMeta),
+		podContainers:    make(map[string][]string),
+		containerNames:   make(map[string]string),
+	}, nil
+}
+
+func (gpf *CGroupPodFinder) FindPods() (map[string]*PodInfo, error) {
+	var err error
+	pods := make(PodMap)
+
+	procs, err := scanProcs(gpf.scanner, gpf.ProcDir)
+	if err != nil {
+		log.Log.Warningf("error scanning for pods in %v: %v", gpf.ProcDir, err)
+		return pods, err
+	}
+
+	podMetas, podContainers, err := readPodLogsDir(gpf.PodLogsDir)
+	if err != nil {
+		// not fatal: we can still report pods by UID
+		log.Log.Warningf("error reading pod names from %v: %v", gpf.PodLogsDir, err)
+	}
+	gpf.podMetas = podMetas
+	gpf.podContainers = podContainers
+
+	containerNames, err := readContainerLogsDir(gpf.ContainerLogsDir)
+	if err != nil {
+		// not fatal: we can still resolve the pods with only one container
+		log.Log.V(2).Infof("error reading container names from %v: %v", gpf.ContainerLogsDir, err)
+	}
+	gpf.containerNames = containerNames
+
+	return pods.MapProcsToPods(gpf, gpf.ProcDir, procs)
+}
+
+// FindPodByPID resolves the pod of the given PID. The container name is available only if the
+// container logs are linked in ContainerLogsDir, or if the pod has only one container.
+func (gpf *CGroupPodFinder) FindPodByPID(pid int32) (PodMeta, error) {
+	info, err := FindPodByCGroup(gpf.ProcDir, pid)
+	if err != nil {
+		return PodMeta{}, fmt.Errorf("no POD found for pid %v: %v", pid, err)
+	}
+	podMeta, ok := gpf.podMetas[info.UID]
+	if !ok {
+		log.Log.V(4).Infof("no name for pid %v on pod %v (%v)", pid, info.UID, info.QOSClass)
+		return PodMeta{
+			UID:      info.UID,
+			Domain:   info.UID,
+			QOSClass: info.QOSClass,
+		}, nil
+	}
+	podMeta.QOSClass = info.QOSClass
+	podMeta.Container = gpf.findContainerName(pid, info.UID)
+	return podMeta, nil
+}
+
+// findContainerName returns the name of the container of the given PID, or empty if it cannot be told
+func (gpf *CGroupPodFinder) findContainerName(pid int32, podUID string) string {
+	containerID, cgroupStyle := FindContainerIDByCGroup(gpf.ProcDir, pid)
+	if isContainerCGroup(cgroupStyle) {
+		if name, ok := gpf.containerNames[containerID]; ok {
+			return name
+		}
+	}
+	if containers := gpf.podContainers[podUID]; len(containers) == 1 {
+		return containers[0]
+	}
+	log.Log.V(4).Infof("no container name for pid %v on pod %v", pid, podUID)
+	return ""
+}
+
+// Close implements the PodFinder interface. There is nothing to release.
+func (gpf *CGroupPodFinder) Close() error {
+	return nil
+}
+
+// readPodLogsDir maps the pod UIDs to PodMetas and to the names of their containers
+func readPodLogsDir(podLogsDir string) (map[string]PodMeta, map[string][]string, error) {
+	podMetas := make(map[string]PodMeta)
+	podContainers := make(map[string][]string)
+	entries, err := ioutil.ReadDir(podLogsDir)
+	if err != nil {
+		return podMetas, podContainers, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		// <namespace>_<name>_<uid>. Neither namespaces nor names can contain underscores.
+		items := strings.Split(entry.Name(), "_")
+		if len(items) != 3 {
+			// legacy layout, just <uid>
+			continue
+		}
+		podMeta := PodMeta{
+			Namespace: items[0],
+			Name:      items[1],
+			UID:       items[2],
+			Domain:    domainFromPodName(items[1]),
+		}
+		if podMeta.Domain != podMeta.Name {
+			podMeta.VMI = podMeta.Domain
+		}
+		podMetas[podMeta.UID] = podMeta
+
+		containers, err := ioutil.ReadDir(filepath.Join(podLogsDir, entry.Name()))
+		if err != nil {
+			log.Log.V(2).Infof("error reading the containers of pod %v: %v", podMeta.UID, err)
+			continue
+		}
+		for _, container := range containers {
+			if container.IsDir() {
+				podContainers[podMeta.UID] = append(podContainers[podMeta.UID], container.Name())
+			}
+		}
+	}
+	return podMetas, podContainers, nil
+}
+
+// readContainerLogsDir maps the container IDs to the container names
+func readContainerLogsDir(containerLogsDir string) (map[string]string, error) {
+	containerNames := make(map[string]string)
+	entries, err := ioutil.ReadDir(containerLogsDir)
+	if err != nil {
+		return containerNames, err
+	}
+	for _, entry := range entries {
+		// <pod name>_<namespace>_<container name>-<container id>.log
+		items := strings.Split(strings.TrimSuffix(entry.Name(), ".log"), "_")
+		if len(items) != 3 {
+			continue
+		}
+		pos := strings.LastIndex(items[2], "-")
+		if pos <= 0 || !isContainerID(items[2][pos+1:]) {
+			continue
+		}
+		containerNames[items[2][pos+1:]] = items[2][:pos]
+	}
+	return containerNames, nil
+}
+
+// domainFromPodName approximates the kubevirt.io/domain annotation the CRI finder uses:
+// virt-launcher pods are named virt-launcher-<vmi name>-<random suffix>
+func domainFromPodName(name string) string {
+	if !strings.HasPrefix(name, virtLauncherPrefix) {
+		return name
+	}
+	domain := name[len(virtLauncherPrefix):]
+	if pos := strings.LastIndex(domain, "-"); pos > 0 {
+		domain = domain[:pos]
+	}
+	return domain
+}
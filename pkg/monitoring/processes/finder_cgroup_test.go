@@ -0,0 +1,183 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"testing"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/pkg/procscanner"
+)
+
+func newTestCGroupPodFinder(t *testing.T) *CGroupPodFinder {
+	gpf, err := NewCGroupPodFinder("testdata/pods", procscanner.ProcScanner{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	gpf.ProcDir = "testdata/proc"
+	gpf.podMetas, gpf.podContainers, err = readPodLogsDir(gpf.PodLogsDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	gpf.containerNames, err = readContainerLogsDir(gpf.ContainerLogsDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return gpf
+}
+
+func TestFindPodByCGroupSystemd(t *testing.T) {
+	info, err := FindPodByCGroup("testdata/proc", 4242)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if info.UID != "6a6a9b3d-5e8a-4a1c-9c4e-2b4f0c8d1e77" {
+		t.Errorf("unexpected UID: %v", info.UID)
+	}
+	if info.QOSClass != QOSBurstable {
+		t.Errorf("unexpected QoS class: %v", info.QOSClass)
+	}
+}
+
+func TestFindPodByCGroupCgroupfs(t *testing.T) {
+	info, err := FindPodByCGroup("testdata/proc", 4343)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if info.UID != "0b9d6c1e-2f4a-4e8b-9c7d-1a2b3c4d5e6f" {
+		t.Errorf("unexpected UID: %v", info.UID)
+	}
+	if info.QOSClass != QOSBestEffort {
+		t.Errorf("unexpected QoS class: %v", info.QOSClass)
+	}
+}
+
+func TestFindPodByCGroupGuaranteed(t *testing.T) {
+	info, ok := parseCGroupPodPath("/kubepods.slice/kubepods-pod6a6a9b3d_5e8a_4a1c_9c4e_2b4f0c8d1e77.slice/crio-abcdef.scope")
+	if !ok {
+		t.Errorf("pod not found")
+		return
+	}
+	if info.UID != "6a6a9b3d-5e8a-4a1c-9c4e-2b4f0c8d1e77" {
+		t.Errorf("unexpected UID: %v", info.UID)
+	}
+	if info.QOSClass != QOSGuaranteed {
+		t.Errorf("unexpected QoS class: %v", info.QOSClass)
+	}
+}
+
+func TestFindPodByCGroupNotInPod(t *testing.T) {
+	_, err := parseProcCGroupPodEntry("testdata/cgroup-empty")
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestCGroupPodFinderResolvesName(t *testing.T) {
+	gpf := newTestCGroupPodFinder(t)
+	podMeta, err := gpf.FindPodByPID(4242)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if podMeta.Domain != "testvmi" || podMeta.VMI != "testvmi" {
+		t.Errorf("unexpected domain: %#v", podMeta)
+	}
+	if podMeta.Namespace != "default" || podMeta.Name != "virt-launcher-testvmi-x7k2p" {
+		t.Errorf("unexpected pod: %#v", podMeta)
+	}
+	if podMeta.Container != "compute" {
+		t.Errorf("unexpected container: %v", podMeta.Container)
+	}
+	if podMeta.QOSClass != QOSBurstable {
+		t.Errorf("unexpected QoS class: %v", podMeta.QOSClass)
+	}
+}
+
+func TestCGroupPodFinderSingleContainer(t *testing.T) {
+	gpf := newTestCGroupPodFinder(t)
+	// without the container logs, the container can be told only if the pod has just one
+	gpf.containerNames = make(map[string]string)
+	podMeta, err := gpf.FindPodByPID(4242)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if podMeta.Container != "" {
+		t.Errorf("unexpected container: %v", podMeta.Container)
+	}
+
+	gpf.podContainers["6a6a9b3d-5e8a-4a1c-9c4e-2b4f0c8d1e77"] = []string{"compute"}
+	podMeta, err = gpf.FindPodByPID(4242)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if podMeta.Container != "compute" {
+		t.Errorf("unexpected container: %v", podMeta.Container)
+	}
+}
+
+func TestReadContainerLogsDir(t *testing.T) {
+	containerNames, err := readContainerLogsDir("testdata/containers")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if len(containerNames) != 2 {
+		t.Errorf("unexpected containers: %v", containerNames)
+	}
+	if name := containerNames["3e8f9a1b2c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f"]; name != "compute" {
+		t.Errorf("unexpected name: %v", name)
+	}
+}
+
+func TestCGroupPodFinderFallsBackToUID(t *testing.T) {
+	gpf := newTestCGroupPodFinder(t)
+	podMeta, err := gpf.FindPodByPID(4343)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if podMeta.Domain != "0b9d6c1e-2f4a-4e8b-9c7d-1a2b3c4d5e6f" || podMeta.UID != podMeta.Domain {
+		t.Errorf("unexpected pod: %#v", podMeta)
+	}
+	if podMeta.QOSClass != QOSBestEffort {
+		t.Errorf("unexpected QoS class: %v", podMeta.QOSClass)
+	}
+}
+
+func TestCGroupPodFinderMissingPID(t *testing.T) {
+	gpf := newTestCGroupPodFinder(t)
+	_, err := gpf.FindPodByPID(1)
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestDomainFromPodName(t *testing.T) {
+	if name := domainFromPodName("virt-launcher-my-vmi-x7k2p"); name != "my-vmi" {
+		t.Errorf("unexpected name: %v", name)
+	}
+	if name := domainFromPodName("some-pod"); name != "some-pod" {
+		t.Errorf("unexpected name: %v", name)
+	}
+}
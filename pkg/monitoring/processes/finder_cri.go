@@ -21,11 +21,15 @@ package processes
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	pb "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
 	"k8s.io/kubernetes/pkg/kubelet/util"
@@ -37,44 +41,190 @@ import (
 const (
 	DefaultTimeout = 10 * time.Second
 	DefaultProcDir = "/proc"
+
+	DefaultReconnectMinDelay = 1 * time.Second
+	DefaultReconnectMaxDelay = 1 * time.Minute
 )
 
+type containerInfo struct {
+	PodSandboxID string
+	Name         string
+}
+
+// ErrCRIDisconnected is returned while the CRIPodFinder is waiting to reconnect to the runtime
+var ErrCRIDisconnected = errors.New("disconnected from the CRI runtime")
+
+// ErrCRIClosed is returned once the CRIPodFinder is closed
+var ErrCRIClosed = errors.New("CRI pod finder closed")
+
 type CRIPodFinder struct {
-	ProcDir        string
-	conn           *grpc.ClientConn
-	client         pb.RuntimeServiceClient
-	containerToPod map[string]string
-	podInfos       map[string]string
-	scanner        procscanner.ProcScanner
+	ProcDir           string
+	APIVersion        string // negotiated CRI API version
+	ReconnectMinDelay time.Duration
+	ReconnectMaxDelay time.Duration
+	endPoint          string
+	timeout           time.Duration
+	lock              sync.Mutex
+	connected         bool
+	closed            bool
+	stopCh            chan struct{} // closed by Close, to stop reconnecting
+	conn              *grpc.ClientConn
+	client            criRuntimeClient
+	containerInfos    map[string]containerInfo
+	podInfos          map[string]PodMeta
+	scanner           procscanner.ProcScanner
 }
 
 func NewCRIPodFinder(runtimeEndPoint string, timeout time.Duration, scanner procscanner.ProcScanner) (*CRIPodFinder, error) {
-	log.Log.Infof("connecting to '%v'...", runtimeEndPoint)
 	pr := &CRIPodFinder{
-		ProcDir: DefaultProcDir,
-		scanner: scanner,
+		ProcDir:           DefaultProcDir,
+		ReconnectMinDelay: DefaultReconnectMinDelay,
+		ReconnectMaxDelay: DefaultReconnectMaxDelay,
+		endPoint:          runtimeEndPoint,
+		timeout:           timeout,
+		scanner:           scanner,
+		stopCh:            make(chan struct{}),
 	}
 
-	addr, dialer, err := getAddressAndDialer(runtimeEndPoint)
+	// a malformed endpoint will never work, unlike a runtime which is not up yet
+	_, _, err := getAddressAndDialer(runtimeEndPoint)
 	if err != nil {
 		return nil, err
 	}
+	err = pr.connect()
+	if err != nil {
+		log.Log.Warningf("cannot connect to '%v', will keep retrying: %v", runtimeEndPoint, err)
+		go pr.reconnect()
+	}
+	return pr, nil
+}
+
+// Connected tells if the CRIPodFinder can currently talk to the runtime
+func (cpf *CRIPodFinder) Connected() bool {
+	cpf.lock.Lock()
+	defer cpf.lock.Unlock()
+	return cpf.connected
+}
 
-	pr.conn, err = grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(timeout), grpc.WithDialer(dialer))
+func (cpf *CRIPodFinder) connect() error {
+	log.Log.Infof("connecting to '%v'...", cpf.endPoint)
+	addr, dialer, err := getAddressAndDialer(cpf.endPoint)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect: %v", err)
+		return err
 	}
 
-	pr.client = pb.NewRuntimeServiceClient(pr.conn)
-	log.Log.Infof("connected to '%v'!", runtimeEndPoint)
-	return pr, nil
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(cpf.timeout), grpc.WithDialer(dialer))
+	if err != nil {
+		return fmt.Errorf("failed to connect: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cpf.timeout)
+	defer cancel()
+	client, apiVersion, ver, err := negotiateCRIClient(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	cpf.lock.Lock()
+	if cpf.closed {
+		cpf.lock.Unlock()
+		conn.Close()
+		return ErrCRIClosed
+	}
+	cpf.conn = conn
+	cpf.client = client
+	cpf.APIVersion = apiVersion
+	cpf.connected = true
+	cpf.lock.Unlock()
+
+	criInfo.Reset()
+	criInfo.WithLabelValues(ver.RuntimeName, ver.RuntimeVersion, apiVersion).Set(1)
+	log.Log.Infof("connected to '%v'! runtime %v %v, CRI API %v", cpf.endPoint, ver.RuntimeName, ver.RuntimeVersion, apiVersion)
+	return nil
+}
+
+// Close disconnects from the runtime, and stops reconnecting if a reconnection is in progress.
+// The CRIPodFinder cannot be used anymore once closed.
+func (cpf *CRIPodFinder) Close() error {
+	cpf.lock.Lock()
+	defer cpf.lock.Unlock()
+	if cpf.closed {
+		return nil
+	}
+	cpf.closed = true
+	if cpf.stopCh != nil {
+		close(cpf.stopCh)
+	}
+	if !cpf.connected {
+		return nil
+	}
+	cpf.connected = false
+	log.Log.Infof("disconnecting from '%v'", cpf.endPoint)
+	return cpf.conn.Close()
+}
+
+// currentClient returns the client to use, or ErrCRIDisconnected while reconnecting
+func (cpf *CRIPodFinder) currentClient() (criRuntimeClient, error) {
+	cpf.lock.Lock()
+	defer cpf.lock.Unlock()
+	if cpf.closed {
+		return nil, ErrCRIClosed
+	}
+	if !cpf.connected {
+		return nil, ErrCRIDisconnected
+	}
+	return cpf.client, nil
+}
+
+// checkConnection inspects the error returned by a CRI call, and starts the reconnection
+// if the runtime is gone (e.g. restarted) or does not speak the negotiated API anymore (e.g. upgraded).
+func (cpf *CRIPodFinder) checkConnection(err error) {
+	code := status.Code(err)
+	if code != codes.Unavailable && code != codes.Unimplemented {
+		return
+	}
+
+	cpf.lock.Lock()
+	defer cpf.lock.Unlock()
+	if !cpf.connected {
+		return
+	}
+	log.Log.Warningf("lost connection to '%v': %v", cpf.endPoint, err)
+	cpf.connected = false
+	cpf.conn.Close()
+	go cpf.reconnect()
+}
+
+// reconnect keeps trying to connect with exponential backoff, until it succeeds or the CRIPodFinder is closed
+func (cpf *CRIPodFinder) reconnect() {
+	delay := cpf.ReconnectMinDelay
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-cpf.stopCh:
+			timer.Stop()
+			log.Log.V(3).Infof("reconnection to '%v' stopped", cpf.endPoint)
+			return
+		}
+		err := cpf.connect()
+		if err == nil || err == ErrCRIClosed {
+			return
+		}
+		delay *= 2
+		if delay > cpf.ReconnectMaxDelay {
+			delay = cpf.ReconnectMaxDelay
+		}
+		log.Log.V(3).Infof("reconnection to '%v' failed, retrying in %v: %v", cpf.endPoint, delay, err)
+	}
 }
 
 func (cpf *CRIPodFinder) FindPods() (map[string]*PodInfo, error) {
 	var err error
 	pods := make(PodMap)
 
-	procs, err := cpf.scanner.Scan(cpf.ProcDir)
+	procs, err := scanProcs(cpf.scanner, cpf.ProcDir)
 	if err != nil {
 		log.Log.Warningf("error scanning for pods in %v: %v", cpf.ProcDir, err)
 		return pods, err
@@ -85,7 +235,7 @@ func (cpf *CRIPodFinder) FindPods() (map[string]*PodInfo, error) {
 		return pods, err
 	}
 
-	return pods.MapProcsToPods(cpf, procs)
+	return pods.MapProcsToPods(cpf, cpf.ProcDir, procs)
 }
 
 func (cpf *CRIPodFinder) updateCRIInfo() error {
@@ -114,14 +264,31 @@ func (cpf *CRIPodFinder) updateInfoContainers() error {
 		Filter: filter,
 	}
 
-	r, err := cpf.client.ListContainers(context.Background(), request)
+	client, err := cpf.currentClient()
+	if err != nil {
+		countError(StageCRIListContainers, err)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cpf.timeout)
+	defer cancel()
+	start := time.Now()
+	r, err := client.ListContainers(ctx, request)
+	observeStage(StageCRIListContainers, start, err)
 	if err != nil {
+		cpf.checkConnection(err)
 		return err
 	}
 
-	cpf.containerToPod = make(map[string]string)
+	cpf.containerInfos = make(map[string]containerInfo)
 	for _, c := range r.GetContainers() {
-		cpf.containerToPod[c.Id] = c.PodSandboxId
+		info := containerInfo{
+			PodSandboxID: c.PodSandboxId,
+		}
+		if c.Metadata != nil {
+			info.Name = c.Metadata.Name
+		}
+		cpf.containerInfos[c.Id] = info
 	}
 
 	return nil
@@ -137,38 +304,68 @@ func (cpf *CRIPodFinder) updateInfoPods() error {
 		Filter: filter,
 	}
 
-	r, err := cpf.client.ListPodSandbox(context.Background(), request)
+	client, err := cpf.currentClient()
+	if err != nil {
+		countError(StageCRIListPods, err)
+		return err
+	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), cpf.timeout)
+	defer cancel()
+	start := time.Now()
+	r, err := client.ListPodSandbox(ctx, request)
+	observeStage(StageCRIListPods, start, err)
 	if err != nil {
+		cpf.checkConnection(err)
 		return err
 	}
 
-	cpf.podInfos = make(map[string]string)
+	cpf.podInfos = make(map[string]PodMeta)
 	for _, p := range r.GetItems() {
-		if domainName, ok := p.Annotations["kubevirt.io/domain"]; ok {
-			cpf.podInfos[p.Id] = domainName
-		} else {
-			cpf.podInfos[p.Id] = p.Metadata.Name
-		}
+		cpf.podInfos[p.Id] = podMetaFromSandbox(p)
 	}
 
 	return nil
 }
 
-func (cpf *CRIPodFinder) FindPodByPID(pid int32) (string, error) {
-	containerId, cgroupStyle := FindContainerIDByCGroup(pid)
-	if cgroupStyle != DockerCGroup {
-		return "", fmt.Errorf("unsupported cgroup style: %v", cgroupStyle)
+func (cpf *CRIPodFinder) FindPodByPID(pid int32) (PodMeta, error) {
+	containerId, cgroupStyle := FindContainerIDByCGroup(cpf.ProcDir, pid)
+	if cgroupStyle == CRIOConmonCGroup {
+		return PodMeta{}, fmt.Errorf("pid %v is the conmon monitor of container %v, not part of it", pid, containerId)
 	}
-	podId, ok := cpf.containerToPod[containerId]
+	if !isContainerCGroup(cgroupStyle) {
+		return PodMeta{}, fmt.Errorf("unsupported cgroup style: %v", cgroupStyle)
+	}
+	ctrInfo, ok := cpf.containerInfos[containerId]
 	if !ok {
-		return "", fmt.Errorf("no POD found for pid %v on container %v", pid, containerId)
+		return PodMeta{}, fmt.Errorf("no POD found for pid %v on container %v", pid, containerId)
 	}
-	podName, ok := cpf.podInfos[podId]
+	podMeta, ok := cpf.podInfos[ctrInfo.PodSandboxID]
 	if !ok {
-		return "", fmt.Errorf("no info for pid %v on container %v on pod %v", pid, containerId, podId)
+		return PodMeta{}, fmt.Errorf("no info for pid %v on container %v on pod %v", pid, containerId, ctrInfo.PodSandboxID)
+	}
+	podMeta.Container = ctrInfo.Name
+	if info, err := FindPodByCGroup(cpf.ProcDir, pid); err == nil {
+		podMeta.QOSClass = info.QOSClass
+	}
+	return podMeta, nil
+}
+
+func podMetaFromSandbox(p *pb.PodSandbox) PodMeta {
+	podMeta := PodMeta{
+		Labels: p.Labels,
+	}
+	if p.Metadata != nil {
+		podMeta.Namespace = p.Metadata.Namespace
+		podMeta.Name = p.Metadata.Name
+		podMeta.UID = p.Metadata.Uid
+	}
+	podMeta.VMI = p.Annotations[DomainAnnotation]
+	podMeta.Domain = podMeta.VMI
+	if podMeta.Domain == "" {
+		podMeta.Domain = podMeta.Name
 	}
-	return podName, nil
+	return podMeta
 }
 
 func getAddressAndDialer(endpoint string) (string, func(addr string, timeout time.Duration) (net.Conn, error), error) {
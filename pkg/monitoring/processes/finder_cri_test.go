@@ -0,0 +1,254 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	pb "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/pkg/procscanner"
+)
+
+func waitForConnected(cpf *CRIPodFinder, connected bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cpf.Connected() == connected {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestCRIPodFinderReconnects(t *testing.T) {
+	fs := newFakeCRIServer(t, CRIAPIv1)
+	defer fs.Close()
+
+	cpf, err := NewCRIPodFinder(fs.EndPoint(), time.Second, procscanner.ProcScanner{})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	cpf.ReconnectMinDelay = 10 * time.Millisecond
+	cpf.ReconnectMaxDelay = 50 * time.Millisecond
+
+	_, err = cpf.FindPods()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	fs.Stop()
+	_, err = cpf.FindPods()
+	if err == nil {
+		t.Errorf("unexpected success with the runtime down")
+		return
+	}
+	if cpf.Connected() {
+		t.Errorf("unexpectedly connected with the runtime down")
+		return
+	}
+	_, err = cpf.FindPods()
+	if err != ErrCRIDisconnected {
+		t.Errorf("unexpected error while disconnected: %v", err)
+		return
+	}
+
+	fs.Start(t)
+	if !waitForConnected(cpf, true, 5*time.Second) {
+		t.Errorf("failed to reconnect")
+		return
+	}
+	_, err = cpf.FindPods()
+	if err != nil {
+		t.Errorf("unexpected error after reconnection: %v", err)
+	}
+}
+
+func TestCRIPodFinderConnectsLater(t *testing.T) {
+	fs := newFakeCRIServer(t, CRIAPIv1)
+	defer fs.Close()
+	fs.Stop()
+
+	cpf, err := NewCRIPodFinder(fs.EndPoint(), 100*time.Millisecond, procscanner.ProcScanner{})
+	if err != nil {
+		t.Errorf("unexpected error with the runtime down: %v", err)
+		return
+	}
+	defer cpf.Close()
+	if cpf.Connected() {
+		t.Errorf("unexpectedly connected with the runtime down")
+		return
+	}
+	_, err = cpf.FindPods()
+	if err != ErrCRIDisconnected {
+		t.Errorf("unexpected error while disconnected: %v", err)
+		return
+	}
+
+	fs.Start(t)
+	if !waitForConnected(cpf, true, 5*time.Second) {
+		t.Errorf("failed to connect once the runtime is up")
+		return
+	}
+	_, err = cpf.FindPods()
+	if err != nil {
+		t.Errorf("unexpected error once connected: %v", err)
+	}
+}
+
+func TestCollectCRIUp(t *testing.T) {
+	testCases := []struct {
+		finder PodFinder
+		values int
+	}{
+		{&CRIPodFinder{}, 1},
+		{&SelfScanner{}, 0},
+	}
+	for _, tc := range testCases {
+		co := Collector{
+			conf:   NewConfig(),
+			mon:    fakeMonitor{},
+			finder: tc.finder,
+		}
+		ch := make(chan prometheus.Metric, 16)
+		co.collectCRIUp(ch)
+		close(ch)
+		if len(ch) != tc.values {
+			t.Errorf("unexpected metrics for %T: %v", tc.finder, len(ch))
+			continue
+		}
+		for m := range ch {
+			// never connected
+			if v := metricValue(t, m); v != 0 {
+				t.Errorf("unexpected CRI status: %v", v)
+			}
+		}
+	}
+}
+
+func TestNewCRIPodFinderMalformedEndPoint(t *testing.T) {
+	_, err := NewCRIPodFinder("ftp://localhost", time.Second, procscanner.ProcScanner{})
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestCRIPodFinderCloseStopsReconnecting(t *testing.T) {
+	fs := newFakeCRIServer(t, CRIAPIv1)
+	defer fs.Close()
+
+	cpf, err := NewCRIPodFinder(fs.EndPoint(), time.Second, procscanner.ProcScanner{})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	cpf.ReconnectMinDelay = 10 * time.Millisecond
+	cpf.ReconnectMaxDelay = 50 * time.Millisecond
+
+	fs.Stop()
+	_, err = cpf.FindPods()
+	if err == nil {
+		t.Errorf("unexpected success with the runtime down")
+		return
+	}
+
+	err = cpf.Close()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	fs.Start(t)
+	if waitForConnected(cpf, true, 200*time.Millisecond) {
+		t.Errorf("unexpectedly reconnected after Close")
+		return
+	}
+	_, err = cpf.FindPods()
+	if err != ErrCRIClosed {
+		t.Errorf("unexpected error once closed: %v", err)
+	}
+	// idempotent
+	err = cpf.Close()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCRIPodFinderClose(t *testing.T) {
+	fs := newFakeCRIServer(t, CRIAPIv1)
+	defer fs.Close()
+
+	cpf, err := NewCRIPodFinder(fs.EndPoint(), time.Second, procscanner.ProcScanner{})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	err = cpf.Close()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if cpf.Connected() {
+		t.Errorf("unexpectedly connected after Close")
+	}
+}
+
+func TestPodMetaFromSandbox(t *testing.T) {
+	podMeta := podMetaFromSandbox(&pb.PodSandbox{
+		Id: "sandbox0",
+		Metadata: &pb.PodSandboxMetadata{
+			Name:      "virt-launcher-testvmi-x7k2p",
+			Namespace: "vms",
+			Uid:       "6a6a9b3d-5e8a-4a1c-9c4e-2b4f0c8d1e77",
+		},
+		Labels: map[string]string{
+			"kubevirt.io": "virt-launcher",
+		},
+		Annotations: map[string]string{
+			DomainAnnotation: "testvmi",
+		},
+	})
+	if podMeta.Domain != "testvmi" || podMeta.VMI != "testvmi" {
+		t.Errorf("unexpected domain: %#v", podMeta)
+	}
+	if podMeta.Namespace != "vms" || podMeta.Name != "virt-launcher-testvmi-x7k2p" || podMeta.UID != "6a6a9b3d-5e8a-4a1c-9c4e-2b4f0c8d1e77" {
+		t.Errorf("unexpected pod: %#v", podMeta)
+	}
+	if podMeta.Labels["kubevirt.io"] != "virt-launcher" {
+		t.Errorf("unexpected labels: %#v", podMeta.Labels)
+	}
+}
+
+func TestPodMetaFromSandboxNotVM(t *testing.T) {
+	podMeta := podMetaFromSandbox(&pb.PodSandbox{
+		Id: "sandbox0",
+		Metadata: &pb.PodSandboxMetadata{
+			Name:      "some-pod",
+			Namespace: "default",
+			Uid:       "0b9d6c1e-2f4a-4e8b-9c7d-1a2b3c4d5e6f",
+		},
+	})
+	if podMeta.Domain != "some-pod" || podMeta.VMI != "" {
+		t.Errorf("unexpected domain: %#v", podMeta)
+	}
+}
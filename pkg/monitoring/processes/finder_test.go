@@ -31,7 +31,7 @@ func TestPodMapBasic(t *testing.T) {
 	sc := &SelfScanner{}
 
 	pods := make(PodMap)
-	podMap, err := pods.MapProcsToPods(sc, procs)
+	podMap, err := pods.MapProcsToPods(sc, DefaultProcDir, procs)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 		return
@@ -50,3 +50,16 @@ func TestPodMapBasic(t *testing.T) {
 		t.Errorf("unexpected pid: found %v expected %v", info.Procs[0].Pid, myPid)
 	}
 }
+
+func TestPodMetaKey(t *testing.T) {
+	// same VM name, different namespaces
+	a := PodMeta{Namespace: "ns1", Name: "virt-launcher-vm-abcde", UID: "uid-a", Container: "compute", Domain: "vm"}
+	b := PodMeta{Namespace: "ns2", Name: "virt-launcher-vm-fghij", UID: "uid-b", Container: "compute", Domain: "vm"}
+	if a.Key() == b.Key() {
+		t.Errorf("unexpected key clash: %v", a.Key())
+	}
+	self := PodMeta{Domain: "self"}
+	if self.Key() != "self" {
+		t.Errorf("unexpected key: %v", self.Key())
+	}
+}
@@ -0,0 +1,154 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/internal/pkg/log"
+)
+
+// DefaultRefreshMaxAge is how old the last successful refresh of the pods can be for the collector to be ready.
+// With background sampling, the collector tolerates missing up to two refreshes, if they take longer.
+const DefaultRefreshMaxAge = 1 * time.Minute
+
+// HealthCheck is a named check of the collector health. Check returns nil if healthy.
+type HealthCheck struct {
+	Name  string
+	Check func() error
+}
+
+// FailedCheck returns a HealthCheck which always fails with the given error
+func FailedCheck(name string, err error) HealthCheck {
+	return HealthCheck{
+		Name: name,
+		Check: func() error {
+			return err
+		},
+	}
+}
+
+// HealthReport is the body of the responses of the health endpoints
+type HealthReport struct {
+	Status string            `json:"status"`           // "ok" or "failed"
+	Failed map[string]string `json:"failed,omitempty"` // name of the failing checks => explanation
+}
+
+// RunHealthChecks runs all the given checks, and reports the failing ones
+func RunHealthChecks(checks []HealthCheck) HealthReport {
+	report := HealthReport{
+		Status: "ok",
+	}
+	for _, hc := range checks {
+		err := hc.Check()
+		if err == nil {
+			continue
+		}
+		if report.Failed == nil {
+			report.Failed = make(map[string]string)
+		}
+		report.Status = "failed"
+		report.Failed[hc.Name] = err.Error()
+	}
+	return report
+}
+
+// NewHealthHandler serves the outcome of the checks returned by the given function as HealthReport:
+// with status 200 if all of them pass, with status 503 otherwise.
+// The checks are fetched on each request, since they change if the configuration is reloaded.
+func NewHealthHandler(checks func() []HealthCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := RunHealthChecks(checks())
+		code := http.StatusOK
+		if len(report.Failed) > 0 {
+			log.Log.V(2).Infof("health checks failed on %v: %v", r.URL.Path, report.Failed)
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+// LivenessChecks returns the checks failing when the collector cannot work at all, hence restarting it may help
+func (co *Collector) LivenessChecks() []HealthCheck {
+	return []HealthCheck{
+		{Name: "procfs", Check: co.checkProcFS},
+	}
+}
+
+// ReadinessChecks returns the checks failing when the collector cannot currently report meaningful metrics
+func (co *Collector) ReadinessChecks() []HealthCheck {
+	checks := []HealthCheck{
+		{Name: "procfs", Check: co.checkProcFS},
+		{Name: "refresh", Check: co.checkRefresh},
+	}
+	if _, ok := co.finder.(*CRIPodFinder); ok {
+		checks = append(checks, HealthCheck{Name: "cri", Check: co.checkCRI})
+	}
+	return checks
+}
+
+func (co *Collector) checkProcFS() error {
+	_, err := ioutil.ReadFile(filepath.Join(DefaultProcDir, "self", "stat"))
+	return err
+}
+
+// refreshMaxAge is how old the last successful refresh can be
+func (co *Collector) refreshMaxAge() time.Duration {
+	if maxAge := 3 * co.conf.Interval.Duration; maxAge > DefaultRefreshMaxAge {
+		return maxAge
+	}
+	return DefaultRefreshMaxAge
+}
+
+// checkRefresh never refreshes the pods by itself: a probe must not wait for a scan of the pods,
+// which is the slowest exactly when the node is under load. Keeping the pods fresh is up to the background sampling.
+func (co *Collector) checkRefresh() error {
+	dm, ok := co.mon.(*DomainMonitor)
+	if !ok {
+		return nil
+	}
+	lastSuccess, err := dm.LastRefresh()
+	if !dm.running() {
+		// sampling at each scrape: the age of the pods only tells when the last scrape was
+		return err
+	}
+	if age := time.Since(lastSuccess); age > co.refreshMaxAge() {
+		if lastSuccess.IsZero() {
+			return fmt.Errorf("pods never refreshed successfully: %v", err)
+		}
+		return fmt.Errorf("last successful refresh of the pods %v ago, last error: %v", age.Round(time.Second), err)
+	}
+	return nil
+}
+
+func (co *Collector) checkCRI() error {
+	cpf, ok := co.finder.(*CRIPodFinder)
+	if !ok || cpf.Connected() {
+		return nil
+	}
+	return ErrCRIDisconnected
+}
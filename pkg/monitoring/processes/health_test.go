@@ -0,0 +1,205 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type failingFinder struct{}
+
+func (ff failingFinder) FindPods() (map[string]*PodInfo, error) {
+	return nil, errors.New("runtime on fire")
+}
+
+func (ff failingFinder) FindPodByPID(pid int32) (PodMeta, error) {
+	return PodMeta{}, errors.New("runtime on fire")
+}
+
+func (ff failingFinder) Close() error {
+	return nil
+}
+
+func newHealthCollector(t *testing.T, finder PodFinder) *Collector {
+	mon, err := NewDomainMonitor(finder)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return &Collector{
+		conf:   NewConfig(),
+		mon:    mon,
+		finder: finder,
+	}
+}
+
+func TestRunHealthChecks(t *testing.T) {
+	report := RunHealthChecks([]HealthCheck{
+		{Name: "good", Check: func() error { return nil }},
+		FailedCheck("bad", errors.New("broken")),
+	})
+	if report.Status != "failed" || len(report.Failed) != 1 || report.Failed["bad"] != "broken" {
+		t.Errorf("unexpected report: %#v", report)
+	}
+
+	report = RunHealthChecks(nil)
+	if report.Status != "ok" || len(report.Failed) != 0 {
+		t.Errorf("unexpected report: %#v", report)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	testCases := []struct {
+		checks []HealthCheck
+		code   int
+		status string
+	}{
+		{nil, http.StatusOK, "ok"},
+		{[]HealthCheck{FailedCheck("cri", ErrCRIDisconnected)}, http.StatusServiceUnavailable, "failed"},
+	}
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		checks := tc.checks
+		NewHealthHandler(func() []HealthCheck { return checks }).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		if rec.Code != tc.code {
+			t.Errorf("unexpected code: %v expected %v", rec.Code, tc.code)
+		}
+		var report HealthReport
+		err := json.Unmarshal(rec.Body.Bytes(), &report)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if report.Status != tc.status {
+			t.Errorf("unexpected status: %v expected %v", report.Status, tc.status)
+		}
+	}
+}
+
+func TestCheckRefresh(t *testing.T) {
+	sc := &SelfScanner{}
+	co := newHealthCollector(t, sc)
+	err := co.checkRefresh()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if sc.Calls() != 0 {
+		t.Errorf("unexpected refresh by the check: %v calls", sc.Calls())
+	}
+}
+
+func TestCheckRefreshFailing(t *testing.T) {
+	co := newHealthCollector(t, failingFinder{})
+	co.mon.Update()
+	err := co.checkRefresh()
+	if err == nil || !strings.Contains(err.Error(), "runtime on fire") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func waitRefresh(t *testing.T, dm *DomainMonitor) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		lastSuccess, err := dm.LastRefresh()
+		if !lastSuccess.IsZero() || err != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("background sampling never refreshed")
+}
+
+func TestCheckRefreshNever(t *testing.T) {
+	co := newHealthCollector(t, failingFinder{})
+	dm := co.mon.(*DomainMonitor)
+	dm.Start(time.Hour)
+	defer dm.Stop()
+	waitRefresh(t, dm)
+
+	err := co.checkRefresh()
+	if err == nil || !strings.Contains(err.Error(), "never refreshed successfully: runtime on fire") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckRefreshStale(t *testing.T) {
+	sc := &SelfScanner{}
+	co := newHealthCollector(t, sc)
+	dm := co.mon.(*DomainMonitor)
+	dm.Start(time.Hour)
+	defer dm.Stop()
+	waitRefresh(t, dm)
+
+	err := co.checkRefresh()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	dm.lock.Lock()
+	dm.lastSuccess = dm.lastSuccess.Add(-2 * co.refreshMaxAge())
+	dm.lock.Unlock()
+	err = co.checkRefresh()
+	if err == nil || !strings.Contains(err.Error(), "last successful refresh") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if sc.Calls() != 1 {
+		t.Errorf("unexpected refresh by the check: %v calls", sc.Calls())
+	}
+}
+
+func TestReadinessChecksCRI(t *testing.T) {
+	co := newHealthCollector(t, &CRIPodFinder{})
+	found := false
+	for _, hc := range co.ReadinessChecks() {
+		if hc.Name != "cri" {
+			continue
+		}
+		found = true
+		if err := hc.Check(); err != ErrCRIDisconnected {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if !found {
+		t.Errorf("missing CRI check")
+	}
+
+	co = newHealthCollector(t, &SelfScanner{})
+	for _, hc := range co.ReadinessChecks() {
+		if hc.Name == "cri" {
+			t.Errorf("unexpected CRI check")
+		}
+	}
+}
+
+func TestRefreshMaxAge(t *testing.T) {
+	co := newHealthCollector(t, &SelfScanner{})
+	if maxAge := co.refreshMaxAge(); maxAge != DefaultRefreshMaxAge {
+		t.Errorf("unexpected max age: %v", maxAge)
+	}
+	co.conf.Interval.Duration = 2 * DefaultRefreshMaxAge
+	if maxAge := co.refreshMaxAge(); maxAge != 6*DefaultRefreshMaxAge {
+		t.Errorf("unexpected max age: %v", maxAge)
+	}
+}
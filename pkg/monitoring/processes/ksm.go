@@ -0,0 +1,213 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/internal/pkg/log"
+)
+
+// DefaultSysDir is where sysfs is mounted
+const DefaultSysDir = "/sys"
+
+// KSMStat is the Kernel Samepage Merging accounting of a process, in bytes.
+// See the kernel Documentation/admin-guide/mm/ksm.rst
+type KSMStat struct {
+	Merging   uint64 // memory merged by KSM
+	Profit    int64  // memory saved by KSM, net of its metadata. Only if HasProfit
+	HasProfit bool
+	// Estimated is true if Merging is taken from /proc/PID/smaps on kernels lacking the KSM accounting:
+	// the estimate is the shared anonymous memory, which includes the pages shared after a fork.
+	Estimated bool
+}
+
+// SampleKSM reads the KSM accounting of the given process, falling back to /proc/PID/smaps
+// on kernels older than 6.1, which lack /proc/PID/ksm_stat and /proc/PID/ksm_merging_pages.
+// procDir is the path where procfs is mounted (default: /proc)
+// Like for SampleIO, lacking the privilege to read these files is not an error: SampleKSM just returns nil.
+func SampleKSM(procDir string, pid int32) (*KSMStat, error) {
+	pidDir := filepath.Join(procDir, strconv.Itoa(int(pid)))
+	ks, err := readKSMStat(pidDir)
+	if os.IsNotExist(err) {
+		ks, err = estimateKSMFromSmaps(filepath.Join(pidDir, "smaps"))
+	}
+	if err != nil {
+		if os.IsPermission(err) {
+			log.Log.V(4).Infof("cannot read the KSM accounting of pid %v: %v", pid, err)
+			return nil, nil
+		}
+		return nil, err
+	}
+	return ks, nil
+}
+
+// readKSMStat reads /proc/PID/ksm_stat, if available, and /proc/PID/ksm_merging_pages
+func readKSMStat(pidDir string) (*KSMStat, error) {
+	pageSize := uint64(os.Getpagesize())
+	ks := &KSMStat{}
+
+	values, err := readKeyValues(filepath.Join(pidDir, "ksm_stat"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// since kernel 6.6
+	if profit, ok := values["ksm_process_profit"]; ok {
+		ks.Profit = profit
+		ks.HasProfit = true
+	}
+	if merging, ok := values["ksm_merging_pages"]; ok {
+		ks.Merging = uint64(merging) * pageSize
+		return ks, nil
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(pidDir, "ksm_merging_pages"))
+	if err != nil {
+		return nil, err
+	}
+	merging, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	ks.Merging = merging * pageSize
+	return ks, nil
+}
+
+// estimateKSMFromSmaps sums the shared part of the anonymous memory of each mapping.
+func estimateKSMFromSmaps(path string) (*KSMStat, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ks := &KSMStat{
+		Estimated: true,
+	}
+	var anonymous, shared uint64
+	flush := func() {
+		if anonymous < shared {
+			shared = anonymous
+		}
+		ks.Merging += shared
+		anonymous, shared = 0, 0
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		items := strings.SplitN(scanner.Text(), ":", 2)
+		if len(items) != 2 || strings.Contains(items[0], " ") {
+			// mapping header, like "7f0e5c000000-7f0e9c000000 rw-p 00000000 00:00 0"
+			flush()
+			continue
+		}
+		if items[0] != "Anonymous" && items[0] != "Shared_Clean" && items[0] != "Shared_Dirty" {
+			continue
+		}
+		value, err := parseKB(items[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed %s entry in %s: %v", items[0], path, err)
+		}
+		if items[0] == "Anonymous" {
+			anonymous = value
+		} else {
+			shared += value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return ks, nil
+}
+
+// NodeKSMStat is the node-wide KSM accounting, from /sys/kernel/mm/ksm
+type NodeKSMStat struct {
+	Running       bool
+	PagesShared   uint64 // shared pages in use
+	PagesSharing  uint64 // sites sharing them, i.e. how much is saved
+	PagesUnshared uint64 // unique pages repeatedly checked for merging
+	PagesVolatile uint64 // pages changing too fast to be merged
+	FullScans     uint64
+	PageSize      uint64
+}
+
+// SampleNodeKSM reads the node-wide KSM accounting.
+// sysDir is the path where sysfs is mounted (default: /sys)
+// Returns nil if the kernel does not support KSM.
+func SampleNodeKSM(sysDir string) (*NodeKSMStat, error) {
+	ksmDir := filepath.Join(sysDir, "kernel", "mm", "ksm")
+	if _, err := os.Stat(ksmDir); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	ns := &NodeKSMStat{
+		PageSize: uint64(os.Getpagesize()),
+	}
+	var run uint64
+	fields := map[string]*uint64{
+		"run":            &run,
+		"pages_shared":   &ns.PagesShared,
+		"pages_sharing":  &ns.PagesSharing,
+		"pages_unshared": &ns.PagesUnshared,
+		"pages_volatile": &ns.PagesVolatile,
+		"full_scans":     &ns.FullScans,
+	}
+	for name, field := range fields {
+		content, err := ioutil.ReadFile(filepath.Join(ksmDir, name))
+		if err != nil {
+			return nil, err
+		}
+		*field, err = strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// 1 is running, 0 is stopped, 2 is stopped after unmerging all the pages
+	ns.Running = run == 1
+	return ns, nil
+}
+
+// readKeyValues parses a file made of "key value" lines. Only the integer values are reported.
+func readKeyValues(path string) (map[string]int64, error) {
+	values := make(map[string]int64)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return values, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		items := strings.Fields(line)
+		if len(items) != 2 {
+			continue
+		}
+		value, err := strconv.ParseInt(items[1], 10, 64)
+		if err != nil {
+			continue // like "ksm_mergeable: yes"
+		}
+		values[items[0]] = value
+	}
+	return values, nil
+}
@@ -0,0 +1,103 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSampleKSM(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	ks, err := SampleKSM("testdata/proc", 4242)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	expected := KSMStat{
+		Merging:   131072 * pageSize,
+		Profit:    520093696,
+		HasProfit: true,
+	}
+	if *ks != expected {
+		t.Errorf("unexpected KSM stats: %#v", ks)
+	}
+}
+
+func TestSampleKSMFromSmaps(t *testing.T) {
+	ks, err := SampleKSM("testdata/proc", 4343)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	// only the anonymous mapping counts: the shared part of the executable is not KSM
+	expected := KSMStat{
+		Merging:   262144 * 1024,
+		Estimated: true,
+	}
+	if *ks != expected {
+		t.Errorf("unexpected KSM stats: %#v", ks)
+	}
+}
+
+func TestSampleKSMMissing(t *testing.T) {
+	_, err := SampleKSM("testdata/proc", 4444)
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestSampleNodeKSM(t *testing.T) {
+	ns, err := SampleNodeKSM("testdata/sys")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if !ns.Running || ns.PagesShared != 12000 || ns.PagesSharing != 480000 || ns.FullScans != 42 {
+		t.Errorf("unexpected node KSM stats: %#v", ns)
+	}
+}
+
+func TestSampleNodeKSMUnsupported(t *testing.T) {
+	ns, err := SampleNodeKSM("testdata/inexistent")
+	if err != nil || ns != nil {
+		t.Errorf("unexpected result: %v %v", ns, err)
+	}
+}
+
+func TestNodeKSMCollector(t *testing.T) {
+	nc := NewNodeKSMCollector(NewConfig())
+	nc.SysDir = "testdata/sys"
+	values := collectMetrics(t, nc, PodInfoMap{})
+
+	pageSize := float64(os.Getpagesize())
+	expected := map[string]float64{
+		"kubevirt_pod_infra_node_ksm_running{}":            1,
+		"kubevirt_pod_infra_node_ksm_bytes{type=sharing}":  480000 * pageSize,
+		"kubevirt_pod_infra_node_ksm_full_scans_total{}":   42,
+		"kubevirt_pod_infra_node_ksm_bytes{type=volatile}": 1200 * pageSize,
+	}
+	for key, value := range expected {
+		got, ok := values[key]
+		if !ok || got != value {
+			t.Errorf("unexpected value for %v: %v (found=%v)", key, got, ok)
+		}
+	}
+}
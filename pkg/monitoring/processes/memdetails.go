@@ -0,0 +1,127 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/internal/pkg/log"
+)
+
+// MemDetails is the detailed memory breakdown of a process, in bytes.
+// See the kernel Documentation/filesystems/proc.txt
+type MemDetails struct {
+	// from /proc/PID/smaps_rollup; only if Rollup is true
+	Rollup        bool
+	PSS           uint64 // resident memory, shared pages accounted proportionally among their users
+	Swap          uint64
+	AnonHugePages uint64 // transparent hugepages
+	// from /proc/PID/status
+	Anonymous uint64 // resident anonymous memory
+	File      uint64 // resident file-backed memory
+	HugeTLB   uint64 // hugetlbfs pages, not accounted in the resident memory
+	Locked    uint64 // mlock()ed memory
+	Pinned    uint64 // memory pinned for DMA, e.g. by VFIO
+}
+
+// SampleMemDetails reads the detailed memory breakdown of the given process.
+// procDir is the path where procfs is mounted (default: /proc)
+// /proc/PID/smaps_rollup is available since kernel 4.14 and, like /proc/PID/io, may not be
+// readable without CAP_SYS_PTRACE: lacking it, only the fields from /proc/PID/status are filled.
+func SampleMemDetails(procDir string, pid int32) (*MemDetails, error) {
+	pidDir := filepath.Join(procDir, strconv.Itoa(int(pid)))
+	md := &MemDetails{}
+
+	err := readKBFields(filepath.Join(pidDir, "status"), map[string]*uint64{
+		"RssAnon":      &md.Anonymous,
+		"RssFile":      &md.File,
+		"HugetlbPages": &md.HugeTLB,
+		"VmLck":        &md.Locked,
+		"VmPin":        &md.Pinned,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = readKBFields(filepath.Join(pidDir, "smaps_rollup"), map[string]*uint64{
+		"Pss":           &md.PSS,
+		"Swap":          &md.Swap,
+		"AnonHugePages": &md.AnonHugePages,
+	})
+	if err != nil {
+		if os.IsPermission(err) || os.IsNotExist(err) {
+			log.Log.V(4).Infof("cannot read the memory rollup of pid %v: %v", pid, err)
+			return md, nil
+		}
+		return nil, err
+	}
+	md.Rollup = true
+	return md, nil
+}
+
+// readKBFields parses a file made of "Key:   $VALUE kB" lines, filling the requested fields.
+// The values are converted in bytes. The missing fields are set to 0: e.g. the status of the
+// kernel threads lacks all the memory fields, and the older kernels lack the newer fields.
+func readKBFields(path string, fields map[string]*uint64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, field := range fields {
+		*field = 0
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		items := strings.SplitN(scanner.Text(), ":", 2)
+		if len(items) != 2 {
+			// smaps_rollup starts with the address range header
+			continue
+		}
+		field, ok := fields[items[0]]
+		if !ok {
+			continue
+		}
+		*field, err = parseKB(items[1])
+		if err != nil {
+			return fmt.Errorf("malformed %s entry in %s: %v", items[0], path, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseKB parses a "$VALUE kB" string, returning the value in bytes
+func parseKB(s string) (uint64, error) {
+	values := strings.Fields(s)
+	if len(values) != 2 || values[1] != "kB" {
+		return 0, fmt.Errorf("unexpected format: %q", s)
+	}
+	value, err := strconv.ParseUint(values[0], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return value * 1024, nil
+}
@@ -0,0 +1,94 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"testing"
+)
+
+func TestSampleMemDetails(t *testing.T) {
+	md, err := SampleMemDetails("testdata/proc", 4242)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	expected := MemDetails{
+		Rollup:        true,
+		PSS:           2290104 * 1024,
+		Swap:          1024 * 1024,
+		AnonHugePages: 2048000 * 1024,
+		Anonymous:     2275640 * 1024,
+		File:          25568 * 1024,
+		HugeTLB:       1048576 * 1024,
+		Locked:        0,
+		Pinned:        2097152 * 1024,
+	}
+	if *md != expected {
+		t.Errorf("unexpected memory details: %#v", md)
+	}
+}
+
+func TestSampleMemDetailsNoRollup(t *testing.T) {
+	md, err := SampleMemDetails("testdata/proc", 4343)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if md.Rollup || md.PSS != 0 {
+		t.Errorf("unexpected rollup: %#v", md)
+	}
+	if md.Anonymous != 2275640*1024 {
+		t.Errorf("unexpected anonymous memory: %v", md.Anonymous)
+	}
+}
+
+func TestSampleMemDetailsMissing(t *testing.T) {
+	_, err := SampleMemDetails("testdata/proc", 4444)
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestReadKBFieldsMissing(t *testing.T) {
+	var value uint64
+	missing := uint64(42)
+	err := readKBFields("testdata/proc/4242/status", map[string]*uint64{
+		"VmLck":      &value,
+		"Inexistent": &missing,
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if missing != 0 {
+		t.Errorf("unexpected value for a missing field: %v", missing)
+	}
+}
+
+func TestSampleMemDetailsKernelThread(t *testing.T) {
+	md, err := SampleMemDetails("testdata/proc", 4646)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if md.Anonymous != 0 || md.Locked != 0 || md.Pinned != 0 || md.HugeTLB != 0 || md.PSS != 0 {
+		t.Errorf("unexpected details: %#v", md)
+	}
+}
@@ -22,11 +22,13 @@ package processes
 import (
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shirou/gopsutil/process"
 
 	"github.com/fromanirh/kubevirt-metrics-collector/internal/pkg/log"
+	"github.com/fromanirh/kubevirt-metrics-collector/pkg/procscanner"
 )
 
 type PodInfoMap map[string]*PodInfo
@@ -35,13 +37,81 @@ type Monitor interface {
 	Update() (PodInfoMap, error)
 }
 
+// Snapshot returns a copy of the map, which the caller is free to modify.
+// The PodInfos are shared and must be treated as read-only.
+func (pods PodInfoMap) Snapshot() PodInfoMap {
+	ret := make(PodInfoMap, len(pods))
+	for name, podInfo := range pods {
+		ret[name] = podInfo
+	}
+	return ret
+}
+
+// AddVhostThreads adds to each pod the vhost kernel threads owned by its processes.
+// vhosts maps the owner PIDs to the vhost kernel threads PIDs, see procscanner.ScanVhost
+func (pods PodInfoMap) AddVhostThreads(vhosts map[int32][]int32) {
+	for podName, podInfo := range pods {
+		var threads []*process.Process
+		for _, proc := range podInfo.Procs {
+			for _, pid := range vhosts[proc.Pid] {
+				thread, err := process.NewProcess(pid)
+				if err != nil {
+					log.Log.V(4).Infof("vhost thread %v of pid %v for pod %v gone: %v", pid, proc.Pid, podName, err)
+					continue
+				}
+				threads = append(threads, thread)
+			}
+		}
+		podInfo.Procs = append(podInfo.Procs, threads...)
+	}
+}
+
 const FreshnessThreshold = 1 * time.Second
 
+// DefaultRefreshersTimeout is how long a refresh waits for the podRefreshers, once the pods are published
+const DefaultRefreshersTimeout = 5 * time.Second
+
+// podRefresher gathers data about the pods which is too slow to gather while collecting,
+// like the one reached over QMP. The DomainMonitor runs the podRefreshers after each refresh.
+type podRefresher interface {
+	refreshPods(pods PodInfoMap)
+}
+
+// refresherRun tracks a podRefresher, which must not run again until its previous run completes
+type refresherRun struct {
+	refresher podRefresher
+	running   int32 // accessed atomically
+}
+
+// refreshCall is a refresh in progress, whose outcome is shared among all the callers
+// of Update which arrive while it runs.
+type refreshCall struct {
+	done chan struct{}
+	pods PodInfoMap
+	err  error
+}
+
 type DomainMonitor struct {
-	podFinder PodFinder
-	lock      sync.RWMutex
-	pods      PodInfoMap
-	timestamp time.Time
+	// Update reuses the last refresh outcome if it is not older than this
+	FreshnessThreshold time.Duration
+	Options            SampleOptions
+	// threads in uninterruptible sleep for longer than this are flagged as stuck. Zero disables the flagging.
+	HungThreshold time.Duration
+	// a refresh waits for the podRefreshers up to this long
+	RefreshersTimeout time.Duration
+	podFinder         PodFinder
+	states            *stateTracker   // accessed only by updatePodInfo
+	scheds            *schedTracker   // accessed only by updatePodInfo
+	refreshers        []*refresherRun // set before Start, see addRefresher
+	flightLock        sync.Mutex      // protects inflight
+	inflight          *refreshCall
+	lock              sync.RWMutex // protects all the fields below
+	pods              PodInfoMap
+	err               error // outcome of the last refresh
+	timestamp         time.Time
+	lastSuccess       time.Time // of the last successful refresh
+	stopCh            chan struct{}
+	doneCh            chan struct{} // closed when the background refresh is over
 }
 
 type SelfMonitor struct {
@@ -56,67 +126,226 @@ func NewSelfMonitor() (Monitor, error) {
 	if err != nil {
 		return mon, err
 	}
-	info := &PodInfo{}
+	info := &PodInfo{
+		Meta: PodMeta{Domain: "self"},
+	}
 	info.Procs = append(info.Procs, self)
 	mon.pods["self"] = info
 	return mon, nil
 }
 
 func (sm *SelfMonitor) Update() (PodInfoMap, error) {
+	SamplePods(sm.pods, SampleOptions{})
 	return sm.pods, nil
 }
 
-func NewDomainMonitor(podFinder PodFinder) (Monitor, error) {
+func NewDomainMonitor(podFinder PodFinder) (*DomainMonitor, error) {
 	return &DomainMonitor{
-		podFinder: podFinder,
-		pods:      make(PodInfoMap),
+		FreshnessThreshold: FreshnessThreshold,
+		RefreshersTimeout:  DefaultRefreshersTimeout,
+		podFinder:          podFinder,
+		states:             newStateTracker(),
+		scheds:             newSchedTracker(),
+		pods:               make(PodInfoMap),
 	}, nil
 }
 
+// addRefresher makes the DomainMonitor run the given podRefresher after each refresh.
+// Must be called before Start.
+func (dm *DomainMonitor) addRefresher(pr podRefresher) {
+	dm.refreshers = append(dm.refreshers, &refresherRun{refresher: pr})
+}
+
+// Start makes the DomainMonitor refresh the pods and sample the processes in the background,
+// every interval. Once started, Update just returns the latest snapshot.
+func (dm *DomainMonitor) Start(interval time.Duration) {
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+	if dm.stopCh != nil {
+		return
+	}
+	dm.stopCh = make(chan struct{})
+	dm.doneCh = make(chan struct{})
+	go dm.run(interval, dm.stopCh, dm.doneCh)
+}
+
+// Stop terminates the background refresh started by Start, waiting for the refresh in progress, if any.
+func (dm *DomainMonitor) Stop() {
+	dm.lock.Lock()
+	if dm.stopCh == nil {
+		dm.lock.Unlock()
+		return
+	}
+	close(dm.stopCh)
+	dm.stopCh = nil
+	doneCh := dm.doneCh
+	dm.lock.Unlock()
+
+	// the refresh needs the lock to complete
+	<-doneCh
+}
+
+func (dm *DomainMonitor) run(interval time.Duration, stopCh <-chan struct{}, doneCh chan<- struct{}) {
+	log.Log.Infof("sampling every %v", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(doneCh)
+	for {
+		dm.refresh()
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			log.Log.Infof("sampling stopped")
+			return
+		}
+	}
+}
+
+func (dm *DomainMonitor) running() bool {
+	dm.lock.RLock()
+	defer dm.lock.RUnlock()
+	return dm.stopCh != nil
+}
+
 func (dm *DomainMonitor) Update() (PodInfoMap, error) {
-	// this is racy, and we don't care
-	age := time.Now().Sub(dm.timestamp)
-	if age <= FreshnessThreshold {
+	if dm.running() || dm.fresh() {
 		return dm.currentPodInfo()
 	}
-	return dm.updatePodInfo()
+	return dm.refresh()
+}
 
+func (dm *DomainMonitor) fresh() bool {
+	dm.lock.RLock()
+	defer dm.lock.RUnlock()
+	return time.Now().Sub(dm.timestamp) <= dm.FreshnessThreshold
+}
+
+// LastRefresh returns when the pods were last refreshed successfully, and the outcome of the last refresh
+func (dm *DomainMonitor) LastRefresh() (time.Time, error) {
+	dm.lock.RLock()
+	defer dm.lock.RUnlock()
+	return dm.lastSuccess, dm.err
 }
 
 func (dm *DomainMonitor) currentPodInfo() (PodInfoMap, error) {
 	dm.lock.RLock()
 	defer dm.lock.RUnlock()
-	return dm.pods, nil
+	if dm.err != nil {
+		return make(PodInfoMap), dm.err
+	}
+	return dm.pods.Snapshot(), nil
 }
 
+// refresh runs updatePodInfo, coalescing the concurrent calls: at most one refresh is
+// running at any given time, and the callers which arrive meanwhile wait for it and share its outcome.
+func (dm *DomainMonitor) refresh() (PodInfoMap, error) {
+	dm.flightLock.Lock()
+	call := dm.inflight
+	if call != nil {
+		dm.flightLock.Unlock()
+		<-call.done
+	} else {
+		call = &refreshCall{
+			done: make(chan struct{}),
+		}
+		dm.inflight = call
+		dm.flightLock.Unlock()
+
+		call.pods, call.err = dm.updatePodInfo()
+
+		dm.flightLock.Lock()
+		dm.inflight = nil
+		dm.flightLock.Unlock()
+		close(call.done)
+	}
+
+	if call.err != nil {
+		return make(PodInfoMap), call.err
+	}
+	return call.pods.Snapshot(), nil
+}
+
+// updatePodInfo must be called only through refresh
 func (dm *DomainMonitor) updatePodInfo() (PodInfoMap, error) {
-	dm.lock.Lock()
-	defer dm.lock.Unlock()
+	// the slow part - scanning and sampling - must not block the readers
 	pods, err := dm.podFinder.FindPods()
+	if err == nil {
+		// the vhost kernel threads live outside the pod cgroups, so no PodFinder can find them
+		vhosts, err := procscanner.ScanVhost(dm.Options.procDir())
+		if err != nil {
+			log.Log.Warningf("error scanning for vhost threads: %v", err)
+		}
+		PodInfoMap(pods).AddVhostThreads(vhosts)
+		SamplePods(pods, dm.Options)
+		dm.states.Update(pods, dm.HungThreshold)
+		dm.scheds.Update(pods)
+	}
+
+	err = dm.publish(pods, err)
 	if err != nil {
-		log.Log.Warningf("error finding available pods: %v", err)
 		return make(PodInfoMap), err
 	}
 
-	podsToRemove := []string{}
-	for name := range dm.pods {
-		_, ok := pods[name]
-		if !ok {
-			// pod is gone
-			podsToRemove = append(podsToRemove, name)
-		}
-	}
+	// the pods are published already: the basic metrics do not wait for the refreshers
+	dm.runRefreshers(pods)
+	return pods, nil
+}
 
-	for _, name := range podsToRemove {
-		delete(dm.pods, name)
+// publish makes the outcome of a refresh available to the readers
+func (dm *DomainMonitor) publish(pods PodInfoMap, err error) error {
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+	// failures are cached too, to avoid hammering a runtime which is in trouble
+	dm.timestamp = time.Now()
+	dm.err = err
+	if err != nil {
+		log.Log.Warningf("error finding available pods: %v", err)
+		return err
 	}
 
-	for name, podInfo := range pods {
-		// since pod content is immutable, we can just overwrite the old data
-		// TODO: log diffs
-		dm.pods[name] = podInfo
-	}
+	dm.lastSuccess = dm.timestamp
+
+	// pods which are gone are dropped, and since pod content is immutable, we can just
+	// take the new data. The readers (e.g. a concurrent Collect) may still be using the
+	// old map, so we replace it instead of updating it in place.
+	// TODO: log diffs
+	dm.pods = pods
 
 	log.Log.V(3).Infof("refreshed %v pods", len(dm.pods))
-	return dm.pods, nil
+	return nil
+}
+
+// runRefreshers runs the podRefreshers concurrently, waiting for them up to RefreshersTimeout.
+// The ones still running afterwards, e.g. waiting for unresponsive VMs, complete in the background,
+// and are skipped by the following refreshes until they do.
+func (dm *DomainMonitor) runRefreshers(pods PodInfoMap) {
+	if len(dm.refreshers) == 0 {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, rr := range dm.refreshers {
+		if !atomic.CompareAndSwapInt32(&rr.running, 0, 1) {
+			log.Log.Warningf("skipping %T: the previous refresh is still running", rr.refresher)
+			continue
+		}
+		wg.Add(1)
+		go func(rr *refresherRun) {
+			defer wg.Done()
+			defer atomic.StoreInt32(&rr.running, 0)
+			rr.refresher.refreshPods(pods)
+		}(rr)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(dm.RefreshersTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Log.Warningf("refreshers still running after %v, leaving them in the background", dm.RefreshersTimeout)
+	}
 }
@@ -21,19 +21,32 @@ package processes
 
 import (
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/shirou/gopsutil/process"
 )
 
 type SelfScanner struct {
-	Skip bool
+	Skip  bool
+	Delay time.Duration
+	calls int32
+}
+
+func (sc *SelfScanner) Calls() int {
+	return int(atomic.LoadInt32(&sc.calls))
 }
 
 func (sc *SelfScanner) FindPods() (map[string]*PodInfo, error) {
+	atomic.AddInt32(&sc.calls, 1)
+	time.Sleep(sc.Delay)
 	ret := make(map[string]*PodInfo)
 	if !sc.Skip {
-		pi := PodInfo{}
+		pi := PodInfo{
+			Meta: PodMeta{Domain: "self"},
+		}
 		proc, err := process.NewProcess(int32(os.Getpid()))
 		if err != nil {
 			return ret, err
@@ -45,8 +58,12 @@ func (sc *SelfScanner) FindPods() (map[string]*PodInfo, error) {
 	return ret, nil
 }
 
-func (sc *SelfScanner) FindPodByPID(pid int32) (string, error) {
-	return "selfPod", nil
+func (sc *SelfScanner) FindPodByPID(pid int32) (PodMeta, error) {
+	return PodMeta{Domain: "selfPod"}, nil
+}
+
+func (sc *SelfScanner) Close() error {
+	return nil
 }
 
 func TestUpdateHappyPath(t *testing.T) {
@@ -73,6 +90,7 @@ func TestUpdatePodDisappears(t *testing.T) {
 		t.Errorf("unexpected error: %v", err)
 		return
 	}
+	mon.FreshnessThreshold = 0
 
 	pods, err := mon.Update()
 	if err != nil {
@@ -93,3 +111,285 @@ func TestUpdatePodDisappears(t *testing.T) {
 		t.Errorf("unexpected pods: %#v", pods)
 	}
 }
+
+func TestUpdateSamples(t *testing.T) {
+	mon, err := NewDomainMonitor(&SelfScanner{})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	pods, err := mon.Update()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	info, ok := pods["self"]
+	if !ok || len(info.Samples) != 1 {
+		t.Errorf("unexpected pods: %#v", pods)
+		return
+	}
+	if info.Samples[0].PID != int32(os.Getpid()) || info.Samples[0].Times == nil || info.Samples[0].MemInfo == nil {
+		t.Errorf("unexpected sample: %#v", info.Samples[0])
+	}
+}
+
+func TestBackgroundSampling(t *testing.T) {
+	mon, err := NewDomainMonitor(&SelfScanner{})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	mon.Start(10 * time.Millisecond)
+	defer mon.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		pods, err := mon.Update()
+		if err == nil && len(pods) == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("background sampling never produced data")
+}
+
+func TestBackgroundSamplingStop(t *testing.T) {
+	sc := &SelfScanner{Delay: 20 * time.Millisecond}
+	mon, err := NewDomainMonitor(sc)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	mon.Start(time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	mon.Stop()
+	if mon.running() {
+		t.Errorf("unexpectedly running after Stop")
+	}
+	calls := sc.Calls()
+	time.Sleep(50 * time.Millisecond)
+	if sc.Calls() != calls {
+		t.Errorf("unexpected refresh after Stop: %v calls, expected %v", sc.Calls(), calls)
+	}
+	// no-op
+	mon.Stop()
+}
+
+func TestUpdateCached(t *testing.T) {
+	sc := &SelfScanner{}
+	mon, err := NewDomainMonitor(sc)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	mon.FreshnessThreshold = time.Hour
+
+	for i := 0; i < 3; i++ {
+		pods, err := mon.Update()
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		if len(pods) != 1 {
+			t.Errorf("unexpected pods: %#v", pods)
+		}
+	}
+	if sc.Calls() != 1 {
+		t.Errorf("unexpected refreshes: %v", sc.Calls())
+	}
+}
+
+func TestUpdateConcurrentRefreshCoalesced(t *testing.T) {
+	sc := &SelfScanner{
+		Delay: 100 * time.Millisecond,
+	}
+	mon, err := NewDomainMonitor(sc)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pods, err := mon.Update()
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if len(pods) != 1 {
+				t.Errorf("unexpected pods: %#v", pods)
+			}
+			// snapshots are private copies
+			delete(pods, "self")
+		}()
+	}
+	wg.Wait()
+
+	if sc.Calls() != 1 {
+		t.Errorf("unexpected refreshes: %v", sc.Calls())
+	}
+	pods, err := mon.Update()
+	if err != nil || len(pods) != 1 {
+		t.Errorf("unexpected pods: %#v (%v)", pods, err)
+	}
+}
+
+func TestUpdateConcurrentWithBackgroundRefresh(t *testing.T) {
+	sc := &SelfScanner{}
+	mon, err := NewDomainMonitor(sc)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	mon.Start(time.Millisecond)
+	defer mon.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				pods, _ := mon.Update()
+				for _, podInfo := range pods {
+					for _, sample := range podInfo.Samples {
+						_ = sample.Times.User
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestAddVhostThreads(t *testing.T) {
+	sc := &SelfScanner{}
+	pods, err := sc.FindPods()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	self := int32(os.Getpid())
+	PodInfoMap(pods).AddVhostThreads(map[int32][]int32{
+		self: {self}, // we just need a live process
+		1:    {1},    // not in any pod
+	})
+	procs := pods["self"].Procs
+	if len(procs) != 2 || procs[1].Pid != self {
+		t.Errorf("unexpected processes: %#v", procs)
+	}
+}
+
+type fakeRefresher struct {
+	calls int32
+}
+
+func (fr *fakeRefresher) refreshPods(pods PodInfoMap) {
+	if _, ok := pods["self"]; ok {
+		atomic.AddInt32(&fr.calls, 1)
+	}
+}
+
+func TestUpdateRunsRefreshers(t *testing.T) {
+	mon, err := NewDomainMonitor(&SelfScanner{})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	fr := &fakeRefresher{}
+	mon.addRefresher(fr)
+
+	_, err = mon.Update()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	// cached
+	_, err = mon.Update()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if calls := atomic.LoadInt32(&fr.calls); calls != 1 {
+		t.Errorf("unexpected refresher calls: %v", calls)
+	}
+}
+
+type blockingRefresher struct {
+	release chan struct{}
+	calls   int32
+	mon     *DomainMonitor
+	pods    int // published when the refresher ran
+}
+
+func (br *blockingRefresher) refreshPods(pods PodInfoMap) {
+	atomic.AddInt32(&br.calls, 1)
+	published, _ := br.mon.currentPodInfo()
+	br.pods = len(published)
+	<-br.release
+}
+
+func TestUpdateDoesNotWaitForSlowRefreshers(t *testing.T) {
+	mon, err := NewDomainMonitor(&SelfScanner{})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	mon.FreshnessThreshold = 0
+	mon.RefreshersTimeout = 10 * time.Millisecond
+	br := &blockingRefresher{
+		release: make(chan struct{}),
+		mon:     mon,
+	}
+	defer close(br.release)
+	fr := &fakeRefresher{}
+	mon.addRefresher(br)
+	mon.addRefresher(fr)
+
+	for i := 0; i < 2; i++ {
+		pods, err := mon.Update()
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		if len(pods) != 1 {
+			t.Errorf("unexpected pods: %#v", pods)
+		}
+	}
+	// still running the first time: skipped the second
+	if calls := atomic.LoadInt32(&br.calls); calls != 1 {
+		t.Errorf("unexpected slow refresher calls: %v", calls)
+	}
+	if calls := atomic.LoadInt32(&fr.calls); calls != 2 {
+		t.Errorf("unexpected refresher calls: %v", calls)
+	}
+}
+
+func TestRefreshersRunAfterPublishing(t *testing.T) {
+	mon, err := NewDomainMonitor(&SelfScanner{})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	br := &blockingRefresher{
+		release: make(chan struct{}),
+		mon:     mon,
+	}
+	close(br.release)
+	mon.addRefresher(br)
+
+	_, err = mon.Update()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if br.pods != 1 {
+		t.Errorf("unexpected pods published before the refreshers: %v", br.pods)
+	}
+}
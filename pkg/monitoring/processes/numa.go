@@ -0,0 +1,142 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/internal/pkg/log"
+)
+
+// NUMAStat is the NUMA placement of a process
+type NUMAStat struct {
+	Memory      map[int]uint64 // bytes, by NUMA node
+	CPUsAllowed string         // like "2-3,8"
+	MemsAllowed string         // like "0"
+}
+
+// SampleNUMA reads the NUMA placement of the given process from /proc/PID/numa_maps and /proc/PID/status.
+// procDir is the path where procfs is mounted (default: /proc)
+// Like for SampleIO, lacking the privilege to read numa_maps is not an error: SampleNUMA just returns nil.
+func SampleNUMA(procDir string, pid int32) (*NUMAStat, error) {
+	pidDir := filepath.Join(procDir, strconv.Itoa(int(pid)))
+	memory, err := readNUMAMaps(filepath.Join(pidDir, "numa_maps"))
+	if err != nil {
+		if os.IsPermission(err) {
+			log.Log.V(4).Infof("cannot read the NUMA maps of pid %v: %v", pid, err)
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	values, err := readStatusValues(filepath.Join(pidDir, "status"), "Cpus_allowed_list", "Mems_allowed_list")
+	if err != nil {
+		return nil, err
+	}
+	return &NUMAStat{
+		Memory:      memory,
+		CPUsAllowed: values["Cpus_allowed_list"],
+		MemsAllowed: values["Mems_allowed_list"],
+	}, nil
+}
+
+// readNUMAMaps sums the pages of all the mappings by NUMA node. See numa(7)
+func readNUMAMaps(path string) (map[int]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	memory := make(map[int]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 7f0e5c000000 bind:0 anon=262144 dirty=262144 N0=262144 kernelpagesize_kB=4
+		pageSize := uint64(0)
+		pages := make(map[int]uint64)
+		for _, item := range strings.Fields(scanner.Text()) {
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			if kv[0] == "kernelpagesize_kB" {
+				pageSize, err = strconv.ParseUint(kv[1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("malformed page size in %s: %v", path, err)
+				}
+				continue
+			}
+			if !strings.HasPrefix(kv[0], "N") {
+				continue
+			}
+			node, err := strconv.Atoi(kv[0][1:])
+			if err != nil {
+				continue
+			}
+			pages[node], err = strconv.ParseUint(kv[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed page count in %s: %v", path, err)
+			}
+		}
+		for node, count := range pages {
+			memory[node] += count * pageSize * 1024
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return memory, nil
+}
+
+// readStatusValues returns the values of the given keys from a /proc/PID/status file.
+// All the requested keys must be present.
+func readStatusValues(path string, keys ...string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	wanted := make(map[string]bool)
+	for _, key := range keys {
+		wanted[key] = true
+	}
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		items := strings.SplitN(scanner.Text(), ":", 2)
+		if len(items) != 2 || !wanted[items[0]] {
+			continue
+		}
+		values[items[0]] = strings.TrimSpace(items[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(values) != len(wanted) {
+		return nil, fmt.Errorf("truncated file %s", path)
+	}
+	return values, nil
+}
@@ -0,0 +1,62 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"testing"
+)
+
+func TestSampleNUMA(t *testing.T) {
+	ns, err := SampleNUMA("testdata/proc", 4242)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if ns.CPUsAllowed != "2-3" || ns.MemsAllowed != "0" {
+		t.Errorf("unexpected allowed sets: %#v", ns)
+	}
+	expected := map[int]uint64{
+		0: (1024+6144+262144)*4096 + 512*2048*1024,
+		1: (2048 + 8) * 4096,
+	}
+	if len(ns.Memory) != len(expected) {
+		t.Errorf("unexpected memory: %#v", ns.Memory)
+		return
+	}
+	for node, amount := range expected {
+		if ns.Memory[node] != amount {
+			t.Errorf("unexpected memory on node %v: %v", node, ns.Memory[node])
+		}
+	}
+}
+
+func TestSampleNUMAMissing(t *testing.T) {
+	_, err := SampleNUMA("testdata/proc", 4343)
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestReadStatusValuesTruncated(t *testing.T) {
+	_, err := readStatusValues("testdata/proc/4343/status", "Cpus_allowed_list")
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
@@ -0,0 +1,430 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/internal/pkg/log"
+)
+
+// DefaultCPUManagerStateFile is where the kubelet CPU manager checkpoints the CPUs assigned to the containers.
+// The collector shares the host PID namespace, so it reaches the file through the root of the host init process:
+// mounting /var/lib/kubelet would expose the volumes of all the pods, and a mount of the file alone would keep
+// showing the first checkpoint, since the kubelet replaces the file on each update.
+const DefaultCPUManagerStateFile = "/proc/1/root/var/lib/kubelet/cpu_manager_state"
+
+// DefaultCGroupDir is where the cgroup filesystems are mounted
+const DefaultCGroupDir = "/sys/fs/cgroup"
+
+// Reasons of the pinning violations
+const (
+	PinningNotExclusive = "not_exclusive" // the vCPU can run on CPUs not exclusively assigned to its container
+	PinningNotPinned    = "not_pinned"    // the vCPU can run on more than one CPU
+	PinningShared       = "shared"        // the vCPU is pinned on the same CPU as another vCPU
+	PinningCGroupCPUSet = "cgroup_cpuset" // the cpuset cgroup of the container is not its exclusive CPUs
+)
+
+var (
+	pinningCompliantDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_vm_cpu_pinning_compliant",
+		"Whether each vCPU thread of the VM is pinned on its own CPU among the ones exclusively assigned to its container (1) or not (0).",
+		vmLabels,
+		nil,
+	)
+	pinningViolationDesc = prometheus.NewDesc(
+		"kubevirt_pod_infra_vm_cpu_pinning_violation",
+		"vCPU threads which are not pinned on their own exclusively assigned CPU, or containers whose cpuset cgroup is not their exclusive CPUs, with their CPUs and the reason.",
+		append(vmLabels, "tid", "vcpu", "cpus", "reason"),
+		nil,
+	)
+)
+
+// CPUSet is a set of CPU ids
+type CPUSet map[int]bool
+
+// ParseCPUList parses a CPU list in the kernel format, like "0-3,8"
+func ParseCPUList(s string) (CPUSet, error) {
+	cpus := make(CPUSet)
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return cpus, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed CPU list %q: %v", s, err)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed CPU list %q: %v", s, err)
+			}
+		}
+		if last < first {
+			return nil, fmt.Errorf("malformed CPU list %q: decreasing range", s)
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus[cpu] = true
+		}
+	}
+	return cpus, nil
+}
+
+// Equals tells if the sets have the same CPUs
+func (cs CPUSet) Equals(other CPUSet) bool {
+	return len(cs) == len(other) && cs.IsSubsetOf(other)
+}
+
+// IsSubsetOf tells if all the CPUs of the set are also in the given one
+func (cs CPUSet) IsSubsetOf(other CPUSet) bool {
+	for cpu := range cs {
+		if !other[cpu] {
+			return false
+		}
+	}
+	return true
+}
+
+func (cs CPUSet) String() string {
+	cpus := make([]int, 0, len(cs))
+	for cpu := range cs {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	items := make([]string, 0, len(cpus))
+	for idx := 0; idx < len(cpus); {
+		last := idx
+		for last+1 < len(cpus) && cpus[last+1] == cpus[last]+1 {
+			last++
+		}
+		if last == idx {
+			items = append(items, strconv.Itoa(cpus[idx]))
+		} else {
+			items = append(items, fmt.Sprintf("%d-%d", cpus[idx], cpus[last]))
+		}
+		idx = last + 1
+	}
+	return strings.Join(items, ",")
+}
+
+// PinningViolation is a vCPU thread which is not pinned on its own CPU among the expected ones,
+// or a process whose cpuset cgroup does not have exactly the expected CPUs.
+type PinningViolation struct {
+	TID    int32 // the PID for the PinningCGroupCPUSet violations
+	VCPU   int   // -1 for the PinningCGroupCPUSet violations
+	CPUs   CPUSet
+	Reason string // see PinningNotExclusive, PinningNotPinned, PinningShared, PinningCGroupCPUSet
+}
+
+// CPUManagerState is the checkpoint of the kubelet CPU manager.
+// See https://kubernetes.io/docs/tasks/administer-cluster/cpu-management-policies/
+type CPUManagerState struct {
+	PolicyName    string                       `json:"policyName"`
+	DefaultCPUSet string                       `json:"defaultCpuSet"`
+	Entries       map[string]map[string]string `json:"entries,omitempty"` // pod UID -> container name -> CPU list
+}
+
+// ReadCPUManagerState reads the checkpoint of the kubelet CPU manager from the given path
+func ReadCPUManagerState(path string) (*CPUManagerState, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &CPUManagerState{}
+	err = json.Unmarshal(content, state)
+	if err != nil {
+		return nil, fmt.Errorf("malformed CPU manager state %s: %v", path, err)
+	}
+	return state, nil
+}
+
+// ExclusiveCPUs returns the CPUs exclusively assigned to the given container, if any.
+// Should the container name be unknown, the pod must have only one container with exclusive CPUs.
+func (st *CPUManagerState) ExclusiveCPUs(podUID, container string) (CPUSet, bool, error) {
+	containers, ok := st.Entries[podUID]
+	if !ok {
+		return nil, false, nil
+	}
+	cpuList, ok := containers[container]
+	if !ok && container == "" && len(containers) == 1 {
+		for _, cpuList = range containers {
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	cpus, err := ParseCPUList(cpuList)
+	if err != nil {
+		return nil, false, err
+	}
+	return cpus, true, nil
+}
+
+// PinningChecker verifies that the vCPU threads of the VMs with dedicated CPUs - that is, of the
+// containers the kubelet CPU manager assigned exclusive CPUs to - are each pinned on its own CPU,
+// among the exclusive ones, and that the cpuset cgroup of their containers has exactly the exclusive CPUs.
+type PinningChecker struct {
+	ProcDir             string
+	CPUManagerStateFile string
+	CGroupDir           string // in the mount namespace of the monitored processes
+	hostname            string
+	lock                sync.Mutex      // protects compliant
+	compliant           map[string]bool // by PodMeta.Key(), to report the changes
+}
+
+func NewPinningChecker(conf *Config) *PinningChecker {
+	return &PinningChecker{
+		ProcDir:             DefaultProcDir,
+		CPUManagerStateFile: DefaultCPUManagerStateFile,
+		CGroupDir:           DefaultCGroupDir,
+		hostname:            conf.Hostname,
+		compliant:           make(map[string]bool),
+	}
+}
+
+func (pc *PinningChecker) vmLabelValues(meta PodMeta) []string {
+	return []string{
+		pc.hostname, meta.Domain, meta.Namespace, meta.Name, meta.UID, meta.VMI,
+	}
+}
+
+func (pc *PinningChecker) collectPods(ch chan<- prometheus.Metric, pods PodInfoMap) {
+	state, err := ReadCPUManagerState(pc.CPUManagerStateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// the CPU manager is not enabled: no container has exclusive CPUs
+			log.Log.V(3).Infof("cannot read the CPU manager state: %v", err)
+		} else {
+			log.Log.Warningf("failed to read the CPU manager state: %v", err)
+		}
+		return
+	}
+
+	compliant := make(map[string]bool)
+	for podName, podInfo := range pods {
+		expected, ok, err := state.ExclusiveCPUs(podInfo.Meta.UID, podInfo.Meta.Container)
+		if err != nil {
+			log.Log.Warningf("failed to read the exclusive CPUs of pod %v: %v", podName, err)
+			continue
+		}
+		if !ok {
+			continue // no dedicated CPUs
+		}
+		for _, proc := range podInfo.Procs {
+			violations, checked, err := pc.Check(proc.Pid, expected)
+			if err != nil {
+				log.Log.Warningf("failed to check the CPU pinning of pid %v for pod %v: %v", proc.Pid, podName, err)
+				continue
+			}
+			if !checked {
+				continue
+			}
+
+			key := podInfo.Meta.Key()
+			compliant[key] = len(violations) == 0
+			pc.reportChange(podName, key, violations)
+
+			err = pc.collectVM(ch, podInfo.Meta, violations)
+			if err != nil {
+				log.Log.Warningf("failed to update CPU pinning for pod %v: %v", podName, err)
+			}
+		}
+	}
+
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	pc.compliant = compliant
+}
+
+func (pc *PinningChecker) reportChange(podName, key string, violations []PinningViolation) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	was, known := pc.compliant[key]
+	is := len(violations) == 0
+	if known && was == is {
+		return
+	}
+	if is {
+		if known {
+			log.Log.Warningf("CPU pinning of pod %v is compliant again", podName)
+		}
+		return
+	}
+	for _, v := range violations {
+		if v.Reason == PinningCGroupCPUSet {
+			log.Log.Warningf("CPU pinning of pod %v violated: pid %v is in a cpuset cgroup with CPUs %v (%v)", podName, v.TID, v.CPUs, v.Reason)
+			continue
+		}
+		log.Log.Warningf("CPU pinning of pod %v violated: vCPU %v (thread %v) can run on CPUs %v (%v)", podName, v.VCPU, v.TID, v.CPUs, v.Reason)
+	}
+}
+
+func (pc *PinningChecker) collectVM(ch chan<- prometheus.Metric, meta PodMeta, violations []PinningViolation) error {
+	compliant := 1.0
+	if len(violations) > 0 {
+		compliant = 0.0
+	}
+	m, err := prometheus.NewConstMetric(
+		pinningCompliantDesc, prometheus.GaugeValue,
+		compliant,
+		pc.vmLabelValues(meta)...,
+	)
+	if err != nil {
+		return err
+	}
+	ch <- m
+
+	for _, v := range violations {
+		vcpu := ""
+		if v.VCPU >= 0 {
+			vcpu = strconv.Itoa(v.VCPU)
+		}
+		m, err = prometheus.NewConstMetric(
+			pinningViolationDesc, prometheus.GaugeValue,
+			1,
+			append(pc.vmLabelValues(meta), strconv.Itoa(int(v.TID)), vcpu, v.CPUs.String(), v.Reason)...,
+		)
+		if err != nil {
+			return err
+		}
+		ch <- m
+	}
+	return nil
+}
+
+// Check verifies that each vCPU thread of the given process is pinned on its own CPU among the expected ones,
+// and that the cpuset cgroup of the process has exactly the expected CPUs.
+// Returns false if the check does not apply: the process has no vCPU threads.
+func (pc *PinningChecker) Check(pid int32, expected CPUSet) ([]PinningViolation, bool, error) {
+	taskDir := filepath.Join(pc.ProcDir, strconv.Itoa(int(pid)), "task")
+	entries, err := ioutil.ReadDir(taskDir)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var pinned []PinningViolation // the candidates, until proven not to share their CPU
+	var violations []PinningViolation
+	vcpusByCPU := make(map[int]int)
+	checked := false
+	for _, entry := range entries {
+		tid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		comm, err := ioutil.ReadFile(filepath.Join(taskDir, entry.Name(), "comm"))
+		if err != nil {
+			continue // gone meanwhile
+		}
+		class, vcpu := ClassifyThread(strings.TrimSpace(string(comm)))
+		if class != VCPUThread {
+			continue
+		}
+
+		values, err := readStatusValues(filepath.Join(taskDir, entry.Name(), "status"), "Cpus_allowed_list")
+		if err != nil {
+			continue // gone meanwhile
+		}
+		cpus, err := ParseCPUList(values["Cpus_allowed_list"])
+		if err != nil {
+			return nil, false, err
+		}
+		checked = true
+		v := PinningViolation{
+			TID:  int32(tid),
+			VCPU: vcpu,
+			CPUs: cpus,
+		}
+		switch {
+		case !cpus.IsSubsetOf(expected):
+			v.Reason = PinningNotExclusive
+			violations = append(violations, v)
+		case len(cpus) != 1:
+			v.Reason = PinningNotPinned
+			violations = append(violations, v)
+		default:
+			for cpu := range cpus {
+				vcpusByCPU[cpu]++
+			}
+			pinned = append(pinned, v)
+		}
+	}
+	for _, v := range pinned {
+		for cpu := range v.CPUs {
+			if vcpusByCPU[cpu] > 1 {
+				v.Reason = PinningShared
+				violations = append(violations, v)
+			}
+		}
+	}
+	if !checked {
+		return nil, false, nil
+	}
+
+	// the affinity of the threads is clamped to their cpuset: if the kubelet failed to update the cgroup,
+	// the threads cannot run on the CPUs they are pinned on
+	cgroupCPUs, err := pc.readCPUSet(pid)
+	if err != nil {
+		log.Log.Warningf("cannot read the cpuset cgroup of pid %v: %v", pid, err)
+	} else if !cgroupCPUs.Equals(expected) {
+		violations = append(violations, PinningViolation{
+			TID:    pid,
+			VCPU:   -1,
+			CPUs:   cgroupCPUs,
+			Reason: PinningCGroupCPUSet,
+		})
+	}
+
+	sort.Slice(violations, func(i, j int) bool {
+		return violations[i].TID < violations[j].TID
+	})
+	return violations, true, nil
+}
+
+// readCPUSet reads the effective CPUs of the cpuset cgroup of the container of the given process, on either
+// the unified (v2) or the legacy (v1) hierarchy. The paths in /proc/PID/cgroup are relative to the cgroup
+// namespace of the reader, hence unusable if the collector runs in its own one: the cgroup filesystems are
+// reached instead through the root of the process, where the container runtime mounts the container cgroup
+// as the root of each hierarchy.
+func (pc *PinningChecker) readCPUSet(pid int32) (CPUSet, error) {
+	cgroupDir := filepath.Join(pc.ProcDir, strconv.Itoa(int(pid)), "root", pc.CGroupDir)
+	content, err := ioutil.ReadFile(filepath.Join(cgroupDir, "cpuset.cpus.effective"))
+	if os.IsNotExist(err) {
+		// on the legacy and the hybrid hierarchies, the cpuset controller has its own
+		content, err = ioutil.ReadFile(filepath.Join(cgroupDir, "cpuset", "cpuset.effective_cpus"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseCPUList(string(content))
+}
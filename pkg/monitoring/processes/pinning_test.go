@@ -0,0 +1,244 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"os"
+	"testing"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+func TestParseCPUList(t *testing.T) {
+	testCases := []struct {
+		list     string
+		expected string
+		size     int
+	}{
+		{"", "", 0},
+		{"0", "0", 1},
+		{"0-3", "0-3", 4},
+		{"0-3,8\n", "0-3,8", 5},
+		{"8,0,1,2", "0-2,8", 4},
+		{"2-3,5-6", "2-3,5-6", 4},
+	}
+	for _, tc := range testCases {
+		cpus, err := ParseCPUList(tc.list)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tc.list, err)
+			continue
+		}
+		if len(cpus) != tc.size || cpus.String() != tc.expected {
+			t.Errorf("unexpected CPUs for %q: %v", tc.list, cpus)
+		}
+	}
+}
+
+func TestParseCPUListMalformed(t *testing.T) {
+	for _, list := range []string{"a", "0-", "3-1", "0,,1"} {
+		_, err := ParseCPUList(list)
+		if err == nil {
+			t.Errorf("unexpected success for %q", list)
+		}
+	}
+}
+
+func TestCPUSetIsSubsetOf(t *testing.T) {
+	expected, _ := ParseCPUList("2-3")
+	pinned, _ := ParseCPUList("2")
+	floating, _ := ParseCPUList("0-3")
+	if !pinned.IsSubsetOf(expected) {
+		t.Errorf("unexpected not subset: %v %v", pinned, expected)
+	}
+	if floating.IsSubsetOf(expected) {
+		t.Errorf("unexpected subset: %v %v", floating, expected)
+	}
+}
+
+func newTestPinningChecker() *PinningChecker {
+	pc := NewPinningChecker(NewConfig())
+	pc.ProcDir = "testdata/proc"
+	pc.CPUManagerStateFile = "testdata/cpu_manager_state"
+	return pc
+}
+
+func TestReadCPUManagerState(t *testing.T) {
+	state, err := ReadCPUManagerState("testdata/cpu_manager_state")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	cpus, ok, err := state.ExclusiveCPUs("7b7b0c4e-6f9a-4b2d-8e1f-3c5d7e9f1a2b", "compute")
+	if err != nil || !ok || cpus.String() != "2-3" {
+		t.Errorf("unexpected exclusive CPUs: %v %v %v", cpus, ok, err)
+	}
+	// single container with exclusive CPUs
+	cpus, ok, err = state.ExclusiveCPUs("7b7b0c4e-6f9a-4b2d-8e1f-3c5d7e9f1a2b", "")
+	if err != nil || !ok || cpus.String() != "2-3" {
+		t.Errorf("unexpected exclusive CPUs: %v %v %v", cpus, ok, err)
+	}
+	_, ok, err = state.ExclusiveCPUs("7b7b0c4e-6f9a-4b2d-8e1f-3c5d7e9f1a2b", "volumecontainerdisk")
+	if err != nil || ok {
+		t.Errorf("unexpected exclusive CPUs: %v %v", ok, err)
+	}
+	_, ok, err = state.ExclusiveCPUs("6a6a9b3d-5e8a-4a1c-9c4e-2b4f0c8d1e77", "compute")
+	if err != nil || ok {
+		t.Errorf("unexpected exclusive CPUs: %v %v", ok, err)
+	}
+}
+
+func TestPinningCheck(t *testing.T) {
+	testCases := []struct {
+		pid      int32
+		expected string
+		tids     []int32
+		reasons  []string
+	}{
+		{4545, "2-3", []int32{4551}, []string{PinningNotPinned}},
+		{4545, "2", []int32{4545, 4551}, []string{PinningCGroupCPUSet, PinningNotExclusive}},
+		{4545, "0-3", []int32{4545, 4551}, []string{PinningCGroupCPUSet, PinningNotPinned}},
+		// the cpuset cgroup is 4-7
+		{4747, "4-5", []int32{4747, 4752, 4753}, []string{PinningCGroupCPUSet, PinningShared, PinningShared}},
+	}
+	pc := newTestPinningChecker()
+	for _, tc := range testCases {
+		expected, _ := ParseCPUList(tc.expected)
+		violations, checked, err := pc.Check(tc.pid, expected)
+		if err != nil {
+			t.Errorf("unexpected error for %v: %v", tc.pid, err)
+			continue
+		}
+		if !checked {
+			t.Errorf("unexpected check skipped for %v", tc.pid)
+			continue
+		}
+		if len(violations) != len(tc.tids) {
+			t.Errorf("unexpected violations for %v on %v: %#v", tc.pid, tc.expected, violations)
+			continue
+		}
+		for i, v := range violations {
+			if v.TID != tc.tids[i] || v.Reason != tc.reasons[i] {
+				t.Errorf("unexpected violation for %v on %v: %#v", tc.pid, tc.expected, v)
+			}
+		}
+	}
+}
+
+func TestReadCPUSet(t *testing.T) {
+	testCases := []struct {
+		pid  int32
+		cpus string
+	}{
+		{4545, "2-3"}, // unified hierarchy
+		{4747, "4-7"}, // legacy hierarchy
+	}
+	pc := newTestPinningChecker()
+	for _, tc := range testCases {
+		cpus, err := pc.readCPUSet(tc.pid)
+		if err != nil {
+			t.Errorf("unexpected error for %v: %v", tc.pid, err)
+			continue
+		}
+		if cpus.String() != tc.cpus {
+			t.Errorf("unexpected CPUs for %v: %v", tc.pid, cpus)
+		}
+	}
+
+	_, err := pc.readCPUSet(4242)
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestPinningCheckNoVCPUs(t *testing.T) {
+	pc := newTestPinningChecker()
+	expected, _ := ParseCPUList("0-3")
+	// no vCPU threads
+	_, checked, err := pc.Check(4242, expected)
+	if err != nil || checked {
+		t.Errorf("unexpected result: %v %v", checked, err)
+	}
+}
+
+func newPinningTestPods(t *testing.T, uid string, pid int32) PodInfoMap {
+	// the process is used only for its PID
+	proc, err := process.NewProcess(int32(os.Getpid()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	proc.Pid = pid
+	return PodInfoMap{
+		"vm": &PodInfo{
+			Meta:  PodMeta{UID: uid, Container: "compute", Domain: "testvmi"},
+			Procs: []*process.Process{proc},
+		},
+	}
+}
+
+func TestPinningChecker(t *testing.T) {
+	pc := newTestPinningChecker()
+	pods := newPinningTestPods(t, "7b7b0c4e-6f9a-4b2d-8e1f-3c5d7e9f1a2b", 4545)
+
+	values := collectMetrics(t, pc, pods)
+	if values["kubevirt_pod_infra_vm_cpu_pinning_compliant{}"] != 0 {
+		t.Errorf("unexpected compliance: %#v", values)
+	}
+	if len(values) != 2 {
+		t.Errorf("unexpected values: %#v", values)
+	}
+	if compliant, ok := pc.compliant[pods["vm"].Meta.Key()]; !ok || compliant {
+		t.Errorf("unexpected state: %#v", pc.compliant)
+	}
+}
+
+func TestPinningCheckerCGroupCPUSet(t *testing.T) {
+	pc := newTestPinningChecker()
+	pods := newPinningTestPods(t, "5c5c1d2e-7a8b-4c3d-9e2f-4d6e8f0a2b3c", 4747)
+
+	values := collectMetrics(t, pc, pods)
+	if values["kubevirt_pod_infra_vm_cpu_pinning_compliant{}"] != 0 {
+		t.Errorf("unexpected compliance: %#v", values)
+	}
+	// the vCPUs sharing a CPU, and the cgroup, which has no vCPU
+	if values["kubevirt_pod_infra_vm_cpu_pinning_violation{vcpu=}"] != 1 || len(values) != 4 {
+		t.Errorf("unexpected values: %#v", values)
+	}
+}
+
+func TestPinningCheckerNoDedicatedCPUs(t *testing.T) {
+	pc := newTestPinningChecker()
+	pods := newPinningTestPods(t, "6a6a9b3d-5e8a-4a1c-9c4e-2b4f0c8d1e77", 4545)
+
+	values := collectMetrics(t, pc, pods)
+	if len(values) != 0 {
+		t.Errorf("unexpected values: %#v", values)
+	}
+}
+
+func TestPinningCheckerNoCPUManager(t *testing.T) {
+	pc := newTestPinningChecker()
+	pc.CPUManagerStateFile = "testdata/inexistent"
+	pods := newPinningTestPods(t, "7b7b0c4e-6f9a-4b2d-8e1f-3c5d7e9f1a2b", 4545)
+
+	values := collectMetrics(t, pc, pods)
+	if len(values) != 0 {
+		t.Errorf("unexpected values: %#v", values)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSampleIO(t *testing.T) {
+	ioStat, err := SampleIO("testdata/proc", 4242)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	expected := IOStat{
+		ReadChars:           2012345678,
+		WriteChars:          1048576000,
+		ReadSyscalls:        120000,
+		WriteSyscalls:       64000,
+		ReadBytes:           536870912,
+		WriteBytes:          1073741824,
+		CancelledWriteBytes: 4096,
+	}
+	if *ioStat != expected {
+		t.Errorf("unexpected I/O stats: %#v", ioStat)
+	}
+}
+
+func TestSampleIOTruncated(t *testing.T) {
+	_, err := SampleIO("testdata/proc", 4343)
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestSampleIOMissing(t *testing.T) {
+	_, err := SampleIO("testdata/proc", 4444)
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestSampleIONotPermitted(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("file permissions are not enforced for root")
+	}
+	dir, err := ioutil.TempDir("", "procio")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(filepath.Join(dir, "4242"), 0755)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "4242", "io"), []byte("rchar: 0\n"), 0000)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	ioStat, err := SampleIO(dir, 4242)
+	if err != nil || ioStat != nil {
+		t.Errorf("unexpected result: %v %v", ioStat, err)
+	}
+}
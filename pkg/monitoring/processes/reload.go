@@ -0,0 +1,218 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/internal/pkg/log"
+)
+
+// DefaultConfigPollInterval is how often the configuration file is checked for changes
+const DefaultConfigPollInterval = 10 * time.Second
+
+// ReloadableCollector is a Collector whose configuration can be replaced at runtime.
+// Each reload creates a new Collector, which replaces the current one only if the
+// new configuration is valid, so an invalid configuration never takes effect.
+type ReloadableCollector struct {
+	lock   sync.RWMutex // protects all the fields below
+	conf   *Config
+	co     *Collector // nil if it could not be created from conf
+	err    error      // why co could not be created
+	closed bool
+}
+
+// NewReloadableCollector creates a ReloadableCollector with the given, already validated, Config.
+// Should the Collector creation fail, the error is returned along with the ReloadableCollector,
+// which reports no metrics until a reload succeeds.
+func NewReloadableCollector(conf *Config) (*ReloadableCollector, error) {
+	co, err := NewCollectorFromConf(conf)
+	if err != nil {
+		configLastReloadSuccessful.Set(0)
+	} else {
+		configLastReloadSuccessful.Set(1)
+	}
+	return &ReloadableCollector{
+		conf: conf,
+		co:   co,
+		err:  err,
+	}, err
+}
+
+// Describe implements the prometheus.Collector interface. It reports no descriptors,
+// making the ReloadableCollector unchecked, because the metrics change with the configuration.
+func (rc *ReloadableCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+// Collect implements the prometheus.Collector interface
+func (rc *ReloadableCollector) Collect(ch chan<- prometheus.Metric) {
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+	if rc.co != nil {
+		rc.co.Collect(ch)
+	}
+}
+
+// Config returns the Config in effect
+func (rc *ReloadableCollector) Config() *Config {
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+	return rc.conf
+}
+
+// ReloadFromFile reads the Config from the given file, and applies it. See Reload.
+func (rc *ReloadableCollector) ReloadFromFile(confFile string) error {
+	conf, err := NewConfigFromFile(confFile)
+	if err != nil {
+		return rc.reloadFailed(err)
+	}
+	return rc.Reload(conf)
+}
+
+// Reload validates the given Config and, if valid, replaces the current Collector with
+// a new one created from it. On failure, the current Collector stays in effect.
+// The settings which cannot change at runtime, like the listen address, are ignored.
+func (rc *ReloadableCollector) Reload(conf *Config) error {
+	old := rc.Config()
+	conf.DebugMode = old.DebugMode
+	err := conf.Validate()
+	if err != nil {
+		return rc.reloadFailed(err)
+	}
+	if conf.ListenAddress != old.ListenAddress {
+		log.Log.Warningf("changing the listen address from '%v' to '%v' requires a restart", old.ListenAddress, conf.ListenAddress)
+		conf.ListenAddress = old.ListenAddress
+	}
+
+	co, err := NewCollectorFromConf(conf)
+	if err != nil {
+		return rc.reloadFailed(err)
+	}
+
+	// waits for the Collect calls in progress
+	rc.lock.Lock()
+	if rc.closed {
+		rc.lock.Unlock()
+		return co.Close()
+	}
+	prev := rc.co
+	rc.conf = conf
+	rc.co = co
+	rc.err = nil
+	rc.lock.Unlock()
+
+	if prev != nil {
+		err = prev.Close()
+		if err != nil {
+			log.Log.Warningf("error closing the previous collector: %v", err)
+		}
+	}
+	configReloads.WithLabelValues("success").Inc()
+	configLastReloadSuccessful.Set(1)
+	log.Log.Infof("configuration reloaded: tracking %v targets", len(conf.Targets))
+	return nil
+}
+
+func (rc *ReloadableCollector) reloadFailed(err error) error {
+	log.Log.Warningf("configuration rejected, keeping the previous one: %v", err)
+	configReloads.WithLabelValues("failure").Inc()
+	configLastReloadSuccessful.Set(0)
+	return err
+}
+
+// Close closes the current Collector
+func (rc *ReloadableCollector) Close() error {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.closed = true
+	if rc.co == nil {
+		return nil
+	}
+	err := rc.co.Close()
+	rc.co = nil
+	return err
+}
+
+// LivenessChecks returns the liveness checks of the current Collector
+func (rc *ReloadableCollector) LivenessChecks() []HealthCheck {
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+	if rc.co == nil {
+		return nil
+	}
+	return rc.co.LivenessChecks()
+}
+
+// ReadinessChecks returns the readiness checks of the current Collector, or a failing check
+// if there is no Collector
+func (rc *ReloadableCollector) ReadinessChecks() []HealthCheck {
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+	if rc.co == nil {
+		return []HealthCheck{FailedCheck("collector", rc.err)}
+	}
+	return rc.co.ReadinessChecks()
+}
+
+// WatchConfig reloads the configuration from the given file each time its content changes, checking
+// every interval, and each time a value is received from trigger (e.g. on SIGHUP), until stopCh is closed.
+// The file is polled, instead of watched with inotify, because kubelet updates the ConfigMap volumes
+// swapping a symlink to a new directory, so the file we opened never changes.
+func (rc *ReloadableCollector) WatchConfig(confFile string, interval time.Duration, trigger <-chan os.Signal, stopCh <-chan struct{}) {
+	content, err := ioutil.ReadFile(confFile)
+	if err != nil {
+		log.Log.Warningf("error reading the configuration file %s: %v", confFile, err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case sig := <-trigger:
+			log.Log.Infof("received %v, reloading the configuration from %s", sig, confFile)
+			if current, err := ioutil.ReadFile(confFile); err == nil {
+				content = current
+			}
+		case <-ticker.C:
+			current, err := ioutil.ReadFile(confFile)
+			if err != nil {
+				// kubelet is swapping the symlinks: we will try again later
+				log.Log.V(3).Infof("error reading the configuration file %s: %v", confFile, err)
+				continue
+			}
+			if bytes.Equal(current, content) {
+				continue
+			}
+			// even if rejected, the new content is not retried until it changes again
+			content = current
+			log.Log.Infof("configuration file %s changed, reloading", confFile)
+		case <-stopCh:
+			return
+		}
+
+		rc.ReloadFromFile(confFile)
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/pkg/procscanner"
+)
+
+func newReloadConfig(targets ...string) *Config {
+	conf := NewConfig()
+	for _, target := range targets {
+		conf.Targets = append(conf.Targets, procscanner.ProcTarget{
+			Name: target,
+			Argv: []string{target},
+		})
+	}
+	conf.ListenAddress = ":9999"
+	conf.PodFinder = CGroupPodFinderName
+	conf.Hostname = "node0"
+	return conf
+}
+
+func newReloadableCollector(t *testing.T, targets ...string) *ReloadableCollector {
+	conf := newReloadConfig(targets...)
+	err := conf.Validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rc, err := NewReloadableCollector(conf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return rc
+}
+
+func checkTargets(conf *Config, targets ...string) bool {
+	if len(conf.Targets) != len(targets) {
+		return false
+	}
+	for idx, target := range targets {
+		if conf.Targets[idx].Name != target {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReload(t *testing.T) {
+	rc := newReloadableCollector(t, "qemu-kvm")
+	defer rc.Close()
+	successes := metricValue(t, configReloads.WithLabelValues("success"))
+
+	conf := newReloadConfig("qemu-kvm", "virt-launcher")
+	conf.ListenAddress = ":8888"
+	err := rc.Reload(conf)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if !checkTargets(rc.Config(), "qemu-kvm", "virt-launcher") {
+		t.Errorf("unexpected targets: %#v", rc.Config().Targets)
+	}
+	if rc.Config().ListenAddress != ":9999" {
+		t.Errorf("unexpected listen address: %v", rc.Config().ListenAddress)
+	}
+	if v := metricValue(t, configReloads.WithLabelValues("success")); v != successes+1 {
+		t.Errorf("unexpected successful reloads: %v (was %v)", v, successes)
+	}
+	if v := metricValue(t, configLastReloadSuccessful); v != 1 {
+		t.Errorf("unexpected last reload outcome: %v", v)
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	rc := newReloadableCollector(t, "qemu-kvm")
+	defer rc.Close()
+	failures := metricValue(t, configReloads.WithLabelValues("failure"))
+
+	err := rc.Reload(newReloadConfig())
+	if err == nil {
+		t.Errorf("unexpected success")
+		return
+	}
+	if !checkTargets(rc.Config(), "qemu-kvm") {
+		t.Errorf("unexpected targets: %#v", rc.Config().Targets)
+	}
+	if v := metricValue(t, configReloads.WithLabelValues("failure")); v != failures+1 {
+		t.Errorf("unexpected failed reloads: %v (was %v)", v, failures)
+	}
+	if v := metricValue(t, configLastReloadSuccessful); v != 0 {
+		t.Errorf("unexpected last reload outcome: %v", v)
+	}
+	if len(rc.ReadinessChecks()) == 0 {
+		t.Errorf("missing readiness checks")
+	}
+}
+
+func TestReloadFromFileMissing(t *testing.T) {
+	rc := newReloadableCollector(t, "qemu-kvm")
+	defer rc.Close()
+
+	err := rc.ReloadFromFile("/nonexistent/config.json")
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+	if !checkTargets(rc.Config(), "qemu-kvm") {
+		t.Errorf("unexpected targets: %#v", rc.Config().Targets)
+	}
+}
+
+// writeConfigMap lays out the configuration like kubelet does for the ConfigMap volumes:
+// config.json -> ..data/config.json, ..data -> <version>
+func writeConfigMap(t *testing.T, dir, version, content string) {
+	err := os.Mkdir(filepath.Join(dir, version), 0755)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, version, "config.json"), []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = os.Symlink(version, filepath.Join(dir, "..data_tmp"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "config.json")); os.IsNotExist(err) {
+		err = os.Symlink(filepath.Join("..data", "config.json"), filepath.Join(dir, "config.json"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func waitForTargets(rc *ReloadableCollector, timeout time.Duration, targets ...string) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if checkTargets(rc.Config(), targets...) {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	writeConfigMap(t, dir, "..v1", `{"targets": [{"name": "qemu-kvm", "argv": ["qemu-kvm"]}], "listenaddress": ":9999", "podfinder": "cgroup"}`)
+
+	rc := newReloadableCollector(t, "qemu-kvm")
+	defer rc.Close()
+	trigger := make(chan os.Signal, 1)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go rc.WatchConfig(filepath.Join(dir, "config.json"), 10*time.Millisecond, trigger, stopCh)
+	// let the watcher read the initial content
+	time.Sleep(50 * time.Millisecond)
+
+	writeConfigMap(t, dir, "..v2", `{"targets": [{"name": "virt-launcher", "argv": ["virt-launcher"]}], "listenaddress": ":9999", "podfinder": "cgroup"}`)
+	if !waitForTargets(rc, 5*time.Second, "virt-launcher") {
+		t.Errorf("configuration not reloaded on change: %#v", rc.Config().Targets)
+		return
+	}
+
+	// an invalid configuration is rejected
+	writeConfigMap(t, dir, "..v3", `{"targets": [], "listenaddress": ":9999", "podfinder": "cgroup"}`)
+	time.Sleep(100 * time.Millisecond)
+	if !checkTargets(rc.Config(), "virt-launcher") {
+		t.Errorf("unexpected targets: %#v", rc.Config().Targets)
+		return
+	}
+
+}
+
+func TestWatchConfigSIGHUP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	writeConfigMap(t, dir, "..v1", `{"targets": [{"name": "qemu-kvm", "argv": ["qemu-kvm"]}], "listenaddress": ":9999", "podfinder": "cgroup"}`)
+
+	rc := newReloadableCollector(t, "qemu-kvm")
+	defer rc.Close()
+	trigger := make(chan os.Signal, 1)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	// never polls during the test
+	go rc.WatchConfig(filepath.Join(dir, "config.json"), time.Hour, trigger, stopCh)
+
+	writeConfigMap(t, dir, "..v2", `{"targets": [{"name": "virt-launcher", "argv": ["virt-launcher"]}], "listenaddress": ":9999", "podfinder": "cgroup"}`)
+	trigger <- syscall.SIGHUP
+	if !waitForTargets(rc, 5*time.Second, "virt-launcher") {
+		t.Errorf("configuration not reloaded on SIGHUP: %#v", rc.Config().Targets)
+	}
+}
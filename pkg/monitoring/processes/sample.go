@@ -0,0 +1,234 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"time"
+
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/process"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/internal/pkg/log"
+)
+
+// ProcSample is a point-in-time measurement of a monitored process
+type ProcSample struct {
+	PID       int32
+	Name      string
+	Timestamp time.Time
+	Times     *cpu.TimesStat
+	MemInfo   *process.MemoryInfoExStat
+	IO        *IOStat        // nil if the I/O accounting is not readable
+	MemDetail *MemDetails    // only if SampleOptions.MemoryDetails
+	KSM       *KSMStat       // only if SampleOptions.KSM, and nil if the KSM accounting is not readable
+	NUMA      *NUMAStat      // only if SampleOptions.NUMA, and nil if the NUMA maps are not readable
+	State     *ProcState     // only if SampleOptions.States
+	Threads   []ThreadSample // only if SampleOptions.Threads
+	Sched     *ProcSchedStat // only if SampleOptions.SchedStats
+}
+
+// SampleOptions selects the optional, more expensive, measurements
+type SampleOptions struct {
+	ProcDir       string // where procfs is mounted (default: /proc)
+	Threads       bool
+	SchedStats    bool
+	MemoryDetails bool
+	KSM           bool
+	NUMA          bool
+	States        bool
+}
+
+func (so SampleOptions) procDir() string {
+	if so.ProcDir == "" {
+		return DefaultProcDir
+	}
+	return so.ProcDir
+}
+
+// SampleProcess measures the given process
+func SampleProcess(proc *process.Process, opts SampleOptions) (*ProcSample, error) {
+	name, err := extractProcName(proc)
+	if err != nil {
+		return nil, err
+	}
+
+	times, err := proc.Times()
+	if err != nil {
+		return nil, err
+	}
+
+	memInfo, err := proc.MemoryInfoEx()
+	if err != nil {
+		return nil, err
+	}
+
+	sample := &ProcSample{
+		PID:       proc.Pid,
+		Name:      name,
+		Timestamp: time.Now(),
+		Times:     times,
+		MemInfo:   memInfo,
+	}
+
+	// the other measurements are best-effort: a failure must not hide the basic ones.
+	// The I/O accounting may be missing, e.g. on kernels without CONFIG_TASK_IO_ACCOUNTING.
+	sample.IO, err = SampleIO(opts.procDir(), proc.Pid)
+	warnOptionalSample("I/O accounting", proc.Pid, err)
+
+	if opts.MemoryDetails {
+		sample.MemDetail, err = SampleMemDetails(opts.procDir(), proc.Pid)
+		warnOptionalSample("memory details", proc.Pid, err)
+	}
+
+	if opts.KSM {
+		sample.KSM, err = SampleKSM(opts.procDir(), proc.Pid)
+		warnOptionalSample("KSM accounting", proc.Pid, err)
+	}
+
+	if opts.NUMA {
+		sample.NUMA, err = SampleNUMA(opts.procDir(), proc.Pid)
+		warnOptionalSample("NUMA maps", proc.Pid, err)
+	}
+
+	if opts.States {
+		sample.State, err = SampleState(opts.procDir(), proc.Pid)
+		warnOptionalSample("thread states", proc.Pid, err)
+	}
+
+	if opts.Threads {
+		sample.Threads, err = SampleThreads(opts.procDir(), proc.Pid)
+		warnOptionalSample("threads", proc.Pid, err)
+	}
+
+	if opts.SchedStats {
+		sample.Sched, err = SampleSchedStat(opts.procDir(), proc.Pid)
+		warnOptionalSample("scheduler statistics", proc.Pid, err)
+	}
+
+	return sample, nil
+}
+
+// warnOptionalSample reports the failure, if any, of an optional measurement of the given process
+func warnOptionalSample(what string, pid int32, err error) {
+	if err == nil {
+		return
+	}
+	log.Log.Warningf("failed to sample the %s of process %v: %v", what, pid, err)
+	countError(StageSampleProcess, err)
+}
+
+// SamplePods measures all the processes of all the given pods.
+// Processes which cannot be measured (e.g. because they are gone) are skipped.
+func SamplePods(pods PodInfoMap, opts SampleOptions) {
+	for podName, podInfo := range pods {
+		podInfo.Samples = make([]*ProcSample, 0, len(podInfo.Procs))
+		for _, proc := range podInfo.Procs {
+			start := time.Now()
+			sample, err := SampleProcess(proc, opts)
+			observeStage(StageSampleProcess, start, err)
+			if err != nil {
+				log.Log.Warningf("failed to sample process %v for pod %v: %v", proc.Pid, podName, err)
+				continue
+			}
+			podInfo.Samples = append(podInfo.Samples, sample)
+		}
+		podInfo.Samples = mergeVhostSamples(podInfo.Samples)
+	}
+}
+
+// mergeVhostSamples merges the samples of all the vhost kernel threads into one: these threads
+// are indistinguishable, being all named VhostProcessName, so reporting them separately would
+// produce duplicate series. The merged sample keeps the PID of the first vhost thread.
+func mergeVhostSamples(samples []*ProcSample) []*ProcSample {
+	var vhost *ProcSample
+	merged := make([]*ProcSample, 0, len(samples))
+	for _, sample := range samples {
+		if sample.Name != VhostProcessName {
+			merged = append(merged, sample)
+			continue
+		}
+		if vhost == nil {
+			vhost = sample
+			merged = append(merged, vhost)
+			continue
+		}
+		vhost.add(sample)
+	}
+	return merged
+}
+
+// add accumulates into the sample the measurements of another one
+func (ps *ProcSample) add(other *ProcSample) {
+	if ps.Times != nil && other.Times != nil {
+		ps.Times.User += other.Times.User
+		ps.Times.System += other.Times.System
+		ps.Times.Iowait += other.Times.Iowait
+	}
+	if ps.MemInfo != nil && other.MemInfo != nil {
+		ps.MemInfo.RSS += other.MemInfo.RSS
+		ps.MemInfo.VMS += other.MemInfo.VMS
+		ps.MemInfo.Shared += other.MemInfo.Shared
+		ps.MemInfo.Text += other.MemInfo.Text
+		ps.MemInfo.Lib += other.MemInfo.Lib
+		ps.MemInfo.Data += other.MemInfo.Data
+		ps.MemInfo.Dirty += other.MemInfo.Dirty
+	}
+	if ps.IO != nil && other.IO != nil {
+		ps.IO.ReadChars += other.IO.ReadChars
+		ps.IO.WriteChars += other.IO.WriteChars
+		ps.IO.ReadSyscalls += other.IO.ReadSyscalls
+		ps.IO.WriteSyscalls += other.IO.WriteSyscalls
+		ps.IO.ReadBytes += other.IO.ReadBytes
+		ps.IO.WriteBytes += other.IO.WriteBytes
+		ps.IO.CancelledWriteBytes += other.IO.CancelledWriteBytes
+	}
+	if ps.MemDetail != nil && other.MemDetail != nil {
+		ps.MemDetail.PSS += other.MemDetail.PSS
+		ps.MemDetail.Swap += other.MemDetail.Swap
+		ps.MemDetail.AnonHugePages += other.MemDetail.AnonHugePages
+		ps.MemDetail.Anonymous += other.MemDetail.Anonymous
+		ps.MemDetail.File += other.MemDetail.File
+		ps.MemDetail.HugeTLB += other.MemDetail.HugeTLB
+		ps.MemDetail.Locked += other.MemDetail.Locked
+		ps.MemDetail.Pinned += other.MemDetail.Pinned
+	}
+	if ps.KSM != nil && other.KSM != nil {
+		ps.KSM.Merging += other.KSM.Merging
+		ps.KSM.Profit += other.KSM.Profit
+	}
+	if ps.NUMA != nil && other.NUMA != nil {
+		if ps.NUMA.Memory == nil {
+			ps.NUMA.Memory = make(map[int]uint64)
+		}
+		for node, bytes := range other.NUMA.Memory {
+			ps.NUMA.Memory[node] += bytes
+		}
+	}
+	if ps.State != nil && other.State != nil {
+		ps.State.Threads = append(ps.State.Threads, other.State.Threads...)
+	}
+	ps.Threads = append(ps.Threads, other.Threads...)
+	if ps.Sched != nil && other.Sched != nil {
+		ps.Sched.Total.RunTime += other.Sched.Total.RunTime
+		ps.Sched.Total.WaitTime += other.Sched.Total.WaitTime
+		ps.Sched.Total.Timeslices += other.Sched.Total.Timeslices
+		ps.Sched.Threads = append(ps.Sched.Threads, other.Sched.Threads...)
+	}
+}
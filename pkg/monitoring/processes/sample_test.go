@@ -0,0 +1,176 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/process"
+)
+
+func TestSampleProcessBestEffort(t *testing.T) {
+	proc, err := process.NewProcess(int32(os.Getpid()))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	// only the I/O accounting is there: all the optional measurements fail
+	procDir, err := ioutil.TempDir("", "sample")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(procDir)
+	pidDir := filepath.Join(procDir, strconv.Itoa(os.Getpid()))
+	err = os.MkdirAll(pidDir, 0755)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	data, err := ioutil.ReadFile("testdata/proc/4242/io")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(pidDir, "io"), data, 0644)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	sample, err := SampleProcess(proc, SampleOptions{
+		ProcDir:       procDir,
+		Threads:       true,
+		SchedStats:    true,
+		MemoryDetails: true,
+		KSM:           true,
+		NUMA:          true,
+		States:        true,
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if sample.Times == nil || sample.MemInfo == nil || sample.IO == nil {
+		t.Errorf("missing basic measurements: %#v", sample)
+	}
+	if sample.MemDetail != nil || sample.Threads != nil || sample.Sched != nil {
+		t.Errorf("unexpected optional measurements: %#v", sample)
+	}
+}
+
+func TestSampleProcessNoIO(t *testing.T) {
+	proc, err := process.NewProcess(int32(os.Getpid()))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	// testdata/proc/4646 has no io file, like the kernels without I/O accounting
+	procDir, err := ioutil.TempDir("", "sample")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(procDir)
+	pidDir, err := filepath.Abs("testdata/proc/4646")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	err = os.Symlink(pidDir, filepath.Join(procDir, strconv.Itoa(os.Getpid())))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	sample, err := SampleProcess(proc, SampleOptions{ProcDir: procDir})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if sample.Times == nil || sample.MemInfo == nil {
+		t.Errorf("missing basic measurements: %#v", sample)
+	}
+	if sample.IO != nil {
+		t.Errorf("unexpected I/O measurements: %#v", sample.IO)
+	}
+}
+
+func fakeVhostSample(pid int32, user float64) *ProcSample {
+	return &ProcSample{
+		PID:       pid,
+		Name:      VhostProcessName,
+		Timestamp: time.Now(),
+		Times:     &cpu.TimesStat{User: user},
+		MemInfo:   &process.MemoryInfoExStat{},
+		Threads:   []ThreadSample{{TID: pid, Comm: "vhost-4242", Class: EmulatorThread, VCPU: -1, User: user}},
+	}
+}
+
+func gatherVhostPods(pods PodInfoMap) error {
+	conf := NewConfig()
+	conf.ThreadMetrics = ThreadMetricsClass
+	reg := prometheus.NewPedanticRegistry()
+	err := reg.Register(Collector{
+		conf: conf,
+		mon:  fakeMonitor{pods: pods},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = reg.Gather()
+	return err
+}
+
+func TestMergeVhostSamples(t *testing.T) {
+	pods := fakeSchemaPods()
+	podInfo := pods["virt-launcher-testvm-abcde"]
+	podInfo.Samples = append(podInfo.Samples, fakeVhostSample(4300, 1.5), fakeVhostSample(4301, 2.5))
+
+	// the vhost threads are indistinguishable: reported separately, they are duplicate series
+	err := gatherVhostPods(pods)
+	if err == nil {
+		t.Errorf("unexpected success with duplicate vhost series")
+		return
+	}
+
+	podInfo.Samples = mergeVhostSamples(podInfo.Samples)
+	if len(podInfo.Samples) != 2 {
+		t.Errorf("unexpected samples: %#v", podInfo.Samples)
+		return
+	}
+	vhost := podInfo.Samples[1]
+	if vhost.PID != 4300 || vhost.Times.User != 4.0 || len(vhost.Threads) != 2 {
+		t.Errorf("unexpected merged sample: %#v", vhost)
+	}
+	err = gatherVhostPods(pods)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SchedStat is the content of a schedstat file. See the kernel Documentation/scheduler/sched-stats.txt
+type SchedStat struct {
+	RunTime    float64 // time spent on the cpu, seconds
+	WaitTime   float64 // time spent waiting on a runqueue, seconds
+	Timeslices uint64  // number of timeslices run on this cpu
+}
+
+// RunDelay is the average time spent waiting on a runqueue before each timeslice, seconds
+func (ss SchedStat) RunDelay() float64 {
+	if ss.Timeslices == 0 {
+		return 0
+	}
+	return ss.WaitTime / float64(ss.Timeslices)
+}
+
+// ThreadSchedStat is the SchedStat of a thread of a monitored process
+type ThreadSchedStat struct {
+	SchedStat
+	TID   int32
+	Class string
+}
+
+// RunDelayBuckets are the upper bounds of the run delay histogram buckets, seconds
+var RunDelayBuckets = []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05}
+
+// ClassSchedStat is the SchedStat of the threads of a class of a monitored process, accumulated
+// since they were first seen, including the threads which exited meanwhile.
+type ClassSchedStat struct {
+	SchedStat
+	Class string
+	// RunDelays counts the timeslices, per bucket of RunDelayBuckets, by the average run delay of their thread
+	// between two refreshes. The counts are cumulative, like the prometheus histogram ones.
+	RunDelays []uint64
+}
+
+// ProcSchedStat is the SchedStat of a monitored process: the sum of the ones of all its threads
+type ProcSchedStat struct {
+	Total   SchedStat
+	Threads []ThreadSchedStat
+	// Classes is set by the DomainMonitor, which tracks the threads across the refreshes
+	Classes []ClassSchedStat
+}
+
+// SampleSchedStat reads the scheduler statistics of all the threads of the given process.
+// procDir is the path where procfs is mounted (default: /proc)
+// Threads which disappear while being sampled are skipped.
+func SampleSchedStat(procDir string, pid int32) (*ProcSchedStat, error) {
+	taskDir := filepath.Join(procDir, strconv.Itoa(int(pid)), "task")
+	entries, err := ioutil.ReadDir(taskDir)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := &ProcSchedStat{
+		Threads: make([]ThreadSchedStat, 0, len(entries)),
+	}
+	for _, entry := range entries {
+		tid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		ss, err := readSchedStat(filepath.Join(taskDir, entry.Name(), "schedstat"))
+		if err != nil {
+			continue
+		}
+		comm, err := ioutil.ReadFile(filepath.Join(taskDir, entry.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+		class, _ := ClassifyThread(strings.TrimSpace(string(comm)))
+
+		ps.Threads = append(ps.Threads, ThreadSchedStat{
+			SchedStat: ss,
+			TID:       int32(tid),
+			Class:     class,
+		})
+		ps.Total.RunTime += ss.RunTime
+		ps.Total.WaitTime += ss.WaitTime
+		ps.Total.Timeslices += ss.Timeslices
+	}
+	return ps, nil
+}
+
+// readSchedStat parses a schedstat file: "$RUN_NS $WAIT_NS $TIMESLICES"
+func readSchedStat(path string) (SchedStat, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return SchedStat{}, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) != 3 {
+		return SchedStat{}, fmt.Errorf("malformed schedstat file %s", path)
+	}
+	runTime, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return SchedStat{}, err
+	}
+	waitTime, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return SchedStat{}, err
+	}
+	timeslices, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return SchedStat{}, err
+	}
+	return SchedStat{
+		RunTime:    float64(runTime) / 1e9,
+		WaitTime:   float64(waitTime) / 1e9,
+		Timeslices: timeslices,
+	}, nil
+}
+
+// schedTracker accumulates the scheduler statistics of the threads across the refreshes, so the sums
+// per thread class never decrease, even if threads exit.
+// It is not safe to use it concurrently: the DomainMonitor serializes the refreshes.
+type schedTracker struct {
+	threads map[int32]SchedStat                   // last seen, by TID
+	classes map[string]map[string]*ClassSchedStat // by pod and process name, then by class
+}
+
+func newSchedTracker() *schedTracker {
+	return &schedTracker{
+		threads: make(map[int32]SchedStat),
+		classes: make(map[string]map[string]*ClassSchedStat),
+	}
+}
+
+// Update accumulates the samples of the given pods, and sets the Classes of each sample.
+func (st *schedTracker) Update(pods PodInfoMap) {
+	threads := make(map[int32]SchedStat)
+	classes := make(map[string]map[string]*ClassSchedStat)
+	for podName, podInfo := range pods {
+		for _, sample := range podInfo.Samples {
+			if sample.Sched == nil {
+				continue
+			}
+			// the series are identified by the pod and the process name, not by the PID,
+			// see mergeVhostSamples
+			key := podName + "/" + sample.Name
+			procClasses, ok := st.classes[key]
+			if !ok {
+				procClasses = make(map[string]*ClassSchedStat)
+			}
+			classes[key] = procClasses
+
+			for _, th := range sample.Sched.Threads {
+				cs, ok := procClasses[th.Class]
+				if !ok {
+					cs = &ClassSchedStat{
+						Class:     th.Class,
+						RunDelays: make([]uint64, len(RunDelayBuckets)),
+					}
+					procClasses[th.Class] = cs
+				}
+				// threads first seen are accounted since they started
+				cs.add(th.SchedStat.since(st.threads[th.TID]))
+				threads[th.TID] = th.SchedStat
+			}
+
+			sample.Sched.Classes = make([]ClassSchedStat, 0, len(procClasses))
+			for _, cs := range procClasses {
+				// the samples are shared with the readers once published: they get a copy
+				snapshot := *cs
+				snapshot.RunDelays = append([]uint64{}, cs.RunDelays...)
+				sample.Sched.Classes = append(sample.Sched.Classes, snapshot)
+			}
+			sort.Slice(sample.Sched.Classes, func(i, j int) bool {
+				return sample.Sched.Classes[i].Class < sample.Sched.Classes[j].Class
+			})
+		}
+	}
+	// processes and threads which are gone are forgotten
+	st.threads = threads
+	st.classes = classes
+}
+
+// since returns the statistics accumulated after the given previous ones of the same thread.
+// A TID may be reused by a new thread: if the statistics went back, they are all new.
+func (ss SchedStat) since(prev SchedStat) SchedStat {
+	if ss.RunTime < prev.RunTime || ss.WaitTime < prev.WaitTime || ss.Timeslices < prev.Timeslices {
+		return ss
+	}
+	return SchedStat{
+		RunTime:    ss.RunTime - prev.RunTime,
+		WaitTime:   ss.WaitTime - prev.WaitTime,
+		Timeslices: ss.Timeslices - prev.Timeslices,
+	}
+}
+
+// add accumulates the statistics of a thread between two refreshes: each of its timeslices
+// is counted in the run delay histogram with the average run delay of the interval.
+func (cs *ClassSchedStat) add(delta SchedStat) {
+	cs.RunTime += delta.RunTime
+	cs.WaitTime += delta.WaitTime
+	cs.Timeslices += delta.Timeslices
+	if delta.Timeslices == 0 {
+		return
+	}
+	delay := delta.RunDelay()
+	for idx, bound := range RunDelayBuckets {
+		if delay <= bound {
+			cs.RunDelays[idx] += delta.Timeslices
+		}
+	}
+}
+
+// Buckets returns the run delay histogram in the format prometheus.NewConstHistogram expects
+func (cs *ClassSchedStat) Buckets() map[float64]uint64 {
+	buckets := make(map[float64]uint64, len(RunDelayBuckets))
+	for idx, bound := range RunDelayBuckets {
+		buckets[bound] = cs.RunDelays[idx]
+	}
+	return buckets
+}
@@ -0,0 +1,228 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestSampleSchedStat(t *testing.T) {
+	ps, err := SampleSchedStat("testdata/proc", 4242)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if len(ps.Threads) != 6 {
+		t.Errorf("unexpected threads: %#v", ps.Threads)
+		return
+	}
+	if ps.Total.Timeslices != 22604 {
+		t.Errorf("unexpected timeslices: %v", ps.Total.Timeslices)
+	}
+	if math.Abs(ps.Total.WaitTime-2.53102) > 1e-9 {
+		t.Errorf("unexpected wait time: %v", ps.Total.WaitTime)
+	}
+	for _, th := range ps.Threads {
+		if th.TID == 4250 {
+			if th.Class != VCPUThread {
+				t.Errorf("unexpected thread: %#v", th)
+			}
+			if math.Abs(th.RunDelay()-0.0001) > 1e-12 {
+				t.Errorf("unexpected run delay: %v", th.RunDelay())
+			}
+		}
+	}
+}
+
+func TestSchedStatRunDelayNoTimeslices(t *testing.T) {
+	ss := SchedStat{RunTime: 1.0}
+	if ss.RunDelay() != 0 {
+		t.Errorf("unexpected run delay: %v", ss.RunDelay())
+	}
+}
+
+func TestReadSchedStatMalformed(t *testing.T) {
+	_, err := readSchedStat("testdata/malformed")
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func fakeSchedPods(threads ...ThreadSchedStat) PodInfoMap {
+	return PodInfoMap{
+		"virt-launcher-testvm-abcde": &PodInfo{
+			Samples: []*ProcSample{
+				{
+					PID:  4242,
+					Name: "qemu-kvm",
+					Sched: &ProcSchedStat{
+						Threads: threads,
+					},
+				},
+			},
+		},
+	}
+}
+
+func trackedClasses(pods PodInfoMap) map[string]ClassSchedStat {
+	classes := make(map[string]ClassSchedStat)
+	for _, cs := range pods["virt-launcher-testvm-abcde"].Samples[0].Sched.Classes {
+		classes[cs.Class] = cs
+	}
+	return classes
+}
+
+func TestSchedTrackerThreadsExit(t *testing.T) {
+	st := newSchedTracker()
+	st.Update(fakeSchedPods(
+		ThreadSchedStat{SchedStat{RunTime: 10, WaitTime: 1, Timeslices: 100}, 4250, VCPUThread},
+		ThreadSchedStat{SchedStat{RunTime: 20, WaitTime: 2, Timeslices: 200}, 4251, VCPUThread},
+		ThreadSchedStat{SchedStat{RunTime: 1, WaitTime: 1, Timeslices: 10}, 4252, EmulatorThread},
+	))
+
+	// 4251 exited, 4253 started
+	pods := fakeSchedPods(
+		ThreadSchedStat{SchedStat{RunTime: 11, WaitTime: 1.5, Timeslices: 110}, 4250, VCPUThread},
+		ThreadSchedStat{SchedStat{RunTime: 1, WaitTime: 1, Timeslices: 10}, 4252, EmulatorThread},
+		ThreadSchedStat{SchedStat{RunTime: 2, WaitTime: 0, Timeslices: 5}, 4253, VCPUThread},
+	)
+	st.Update(pods)
+	classes := trackedClasses(pods)
+	if len(classes) != 2 {
+		t.Errorf("unexpected classes: %#v", classes)
+		return
+	}
+	vcpu := classes[VCPUThread]
+	if vcpu.RunTime != 33 || vcpu.WaitTime != 3.5 || vcpu.Timeslices != 315 {
+		t.Errorf("unexpected vCPU stats: %#v", vcpu)
+	}
+	emulator := classes[EmulatorThread]
+	if emulator.RunTime != 1 || emulator.WaitTime != 1 || emulator.Timeslices != 10 {
+		t.Errorf("unexpected emulator stats: %#v", emulator)
+	}
+}
+
+func TestSchedTrackerRunDelays(t *testing.T) {
+	st := newSchedTracker()
+	st.Update(fakeSchedPods(
+		// 5us per timeslice
+		ThreadSchedStat{SchedStat{RunTime: 1, WaitTime: .0005, Timeslices: 100}, 4250, VCPUThread},
+	))
+	pods := fakeSchedPods(
+		// 800us per timeslice since the previous refresh
+		ThreadSchedStat{SchedStat{RunTime: 2, WaitTime: .0085, Timeslices: 110}, 4250, VCPUThread},
+	)
+	st.Update(pods)
+	vcpu := trackedClasses(pods)[VCPUThread]
+	buckets := vcpu.Buckets()
+	if buckets[.00001] != 100 || buckets[.0005] != 100 || buckets[.001] != 110 || buckets[.05] != 110 {
+		t.Errorf("unexpected run delays: %v", buckets)
+	}
+}
+
+func TestSchedTrackerReusedTID(t *testing.T) {
+	st := newSchedTracker()
+	st.Update(fakeSchedPods(
+		ThreadSchedStat{SchedStat{RunTime: 10, WaitTime: 1, Timeslices: 100}, 4250, VCPUThread},
+	))
+	pods := fakeSchedPods(
+		ThreadSchedStat{SchedStat{RunTime: 1, WaitTime: .5, Timeslices: 10}, 4250, VCPUThread},
+	)
+	st.Update(pods)
+	vcpu := trackedClasses(pods)[VCPUThread]
+	if vcpu.RunTime != 11 || vcpu.WaitTime != 1.5 || vcpu.Timeslices != 110 {
+		t.Errorf("unexpected vCPU stats: %#v", vcpu)
+	}
+}
+
+func TestSchedTrackerSnapshots(t *testing.T) {
+	st := newSchedTracker()
+	pods := fakeSchedPods(
+		ThreadSchedStat{SchedStat{RunTime: 1, WaitTime: .0005, Timeslices: 100}, 4250, VCPUThread},
+	)
+	st.Update(pods)
+	st.Update(fakeSchedPods(
+		ThreadSchedStat{SchedStat{RunTime: 2, WaitTime: .001, Timeslices: 200}, 4250, VCPUThread},
+	))
+	// the published samples are not changed by the following refreshes
+	vcpu := trackedClasses(pods)[VCPUThread]
+	if vcpu.Timeslices != 100 || vcpu.Buckets()[.00001] != 100 {
+		t.Errorf("unexpected vCPU stats: %#v", vcpu)
+	}
+}
+
+func TestCollectSchedStat(t *testing.T) {
+	for schema, prefix := range map[string]string{
+		MetricsSchemaV1: "kubevirt_pod_infra_sched_",
+		MetricsSchemaV2: "kubevirt_pod_infra_process_sched_",
+	} {
+		conf := NewConfig()
+		conf.MetricsSchema = schema
+		co := &Collector{conf: conf}
+		pods := fakeSchemaPods()
+		podInfo := pods["virt-launcher-testvm-abcde"]
+		sample := podInfo.Samples[0]
+		var err error
+		sample.Sched, err = SampleSchedStat("testdata/proc", 4242)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		newSchedTracker().Update(pods)
+
+		ch := make(chan prometheus.Metric, 32)
+		err = co.collectSchedStat(ch, podInfo.Meta, sample)
+		close(ch)
+		if err != nil {
+			t.Errorf("unexpected error for schema %v: %v", schema, err)
+			continue
+		}
+		names := make(map[string]int)
+		for m := range ch {
+			var pb dto.Metric
+			err = m.Write(&pb)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			name := strings.Split(m.Desc().String(), "\"")[1]
+			if strings.HasSuffix(name, "_total") && pb.Counter == nil {
+				t.Errorf("unexpected type for schema %v: %v", schema, pb.String())
+			}
+			if name == prefix+"run_delay_seconds" {
+				if pb.Histogram == nil {
+					t.Errorf("unexpected type for schema %v: %v", schema, pb.String())
+				} else if pb.Histogram.GetSampleCount() == 0 || len(pb.Histogram.Bucket) != len(RunDelayBuckets) {
+					t.Errorf("unexpected histogram for schema %v: %v", schema, pb.String())
+				}
+			}
+			names[name]++
+		}
+		// running and waiting, timeslices and run delays for the vcpu, iothread and emulator classes
+		if names[prefix+"seconds_total"] != 6 || names[prefix+"timeslices_total"] != 3 || names[prefix+"run_delay_seconds"] != 3 {
+			t.Errorf("unexpected metrics for schema %v: %v", schema, names)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metric schemas selectable in the Config
+const (
+	MetricsSchemaV1 = "v1" // the original metrics, kept for the existing dashboards
+	MetricsSchemaV2 = "v2" // the redesigned metrics: proper counters and one dimension per label
+)
+
+// v2Labels are the labels of all the per-process metrics in the v2 schema
+var v2Labels = []string{
+	"host",      // On which host is the domain running?
+	"domain",    // Which domain the process belongs to?
+	"process",   // What's the process?
+	"namespace", // Which namespace the pod belongs to?
+	"pod",       // Which pod the process belongs to?
+	"pod_uid",   // Which pod, unambiguously, the process belongs to?
+	"container", // Which container the process belongs to?
+	"vmi",       // Which VMI the pod runs, if any?
+	"qos_class", // Which QoS class the pod belongs to?
+}
+
+// processMetric is a per-process metric, exposed with different name, type and labels in each schema.
+// In the v1 schema the measure is reported in the "type" label; in the v2 schema it is reported
+// in the measureLabel label, or not at all if the metric has only one measure.
+type processMetric struct {
+	v1           *prometheus.Desc
+	v1Type       prometheus.ValueType
+	v2           *prometheus.Desc
+	v2Type       prometheus.ValueType
+	measureLabel string
+}
+
+// schemaName is the name and the type of a metric in a schema
+type schemaName struct {
+	Name string
+	Type prometheus.ValueType
+}
+
+func newProcessMetric(help string, v1, v2 schemaName, measureLabel string, extraLabels ...string) *processMetric {
+	v1Labels := append(append([]string{}, labels...), extraLabels...)
+	v2LabelNames := append([]string{}, v2Labels...)
+	if measureLabel != "" {
+		v2LabelNames = append(v2LabelNames, measureLabel)
+	}
+	v2LabelNames = append(v2LabelNames, extraLabels...)
+	return &processMetric{
+		v1:           prometheus.NewDesc(v1.Name, help, v1Labels, nil),
+		v1Type:       v1.Type,
+		v2:           prometheus.NewDesc(v2.Name, help, v2LabelNames, nil),
+		v2Type:       v2.Type,
+		measureLabel: measureLabel,
+	}
+}
+
+// processMetricDesc returns the descriptor, the value type and the label values of the given measure
+// of the given process in the configured schema
+func (co *Collector) processMetricDesc(pm *processMetric, meta PodMeta, sample *ProcSample, measure string, extra ...string) (*prometheus.Desc, prometheus.ValueType, []string) {
+	if co.conf.MetricsSchema != MetricsSchemaV2 {
+		return pm.v1, pm.v1Type, append(co.labelValues(meta, sample, measure), extra...)
+	}
+	values := []string{
+		co.conf.Hostname, meta.Domain, sample.Name,
+		meta.Namespace, meta.Name, meta.UID, meta.Container, meta.VMI, meta.QOSClass,
+	}
+	if pm.measureLabel != "" {
+		values = append(values, measure)
+	}
+	return pm.v2, pm.v2Type, append(values, extra...)
+}
+
+// newProcessMetric creates the metric for the given measure of the given process in the configured schema
+func (co *Collector) newProcessMetric(pm *processMetric, value float64, meta PodMeta, sample *ProcSample, measure string, extra ...string) (prometheus.Metric, error) {
+	desc, valueType, values := co.processMetricDesc(pm, meta, sample, measure, extra...)
+	return prometheus.NewConstMetric(desc, valueType, value, values...)
+}
@@ -0,0 +1,204 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/process"
+)
+
+type fakeMonitor struct {
+	pods PodInfoMap
+}
+
+func (fm fakeMonitor) Update() (PodInfoMap, error) {
+	return fm.pods, nil
+}
+
+func fakeSchemaPods() PodInfoMap {
+	return PodInfoMap{
+		"virt-launcher-testvm-abcde": &PodInfo{
+			Meta: PodMeta{
+				Name:      "virt-launcher-testvm-abcde",
+				Namespace: "default",
+				UID:       "4d8ba4be-0b1d-4c5b-a0a5-8d7bfa9c4d30",
+				Domain:    "testvm",
+				VMI:       "testvm",
+			},
+			Samples: []*ProcSample{
+				{
+					PID:       4242,
+					Name:      "qemu-kvm",
+					Timestamp: time.Now(),
+					Times:     &cpu.TimesStat{User: 12.5, System: 3.25},
+					MemInfo:   &process.MemoryInfoExStat{VMS: 4096, RSS: 2048, Shared: 1024, Dirty: 512},
+					IO:        &IOStat{ReadBytes: 100, WriteBytes: 200},
+				},
+			},
+		},
+	}
+}
+
+// collectSchema returns the metrics the Collector emits as "name{labels} type" => value.
+// Only the labels describing the measure are included.
+func collectSchema(t *testing.T, schema string) map[string]float64 {
+	conf := NewConfig()
+	conf.Hostname = "node0"
+	conf.MetricsSchema = schema
+	co := Collector{
+		conf: conf,
+		mon:  fakeMonitor{pods: fakeSchemaPods()},
+	}
+
+	ch := make(chan prometheus.Metric, 1024)
+	co.Collect(ch)
+	close(ch)
+
+	ret := make(map[string]float64)
+	for m := range ch {
+		var pb dto.Metric
+		err := m.Write(&pb)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		name := strings.Split(m.Desc().String(), "\"")[1]
+		var labels []string
+		for _, lp := range pb.Label {
+			switch lp.GetName() {
+			case "type", "mode", "kind", "operation":
+				labels = append(labels, lp.GetName()+"="+lp.GetValue())
+			}
+		}
+		key := name + "{" + strings.Join(labels, ",") + "}"
+		switch {
+		case pb.Gauge != nil:
+			ret[key+" gauge"] = pb.Gauge.GetValue()
+		case pb.Counter != nil:
+			ret[key+" counter"] = pb.Counter.GetValue()
+		}
+	}
+	return ret
+}
+
+func checkMetrics(t *testing.T, metrics, expected map[string]float64) {
+	for key, value := range expected {
+		got, ok := metrics[key]
+		if !ok {
+			t.Errorf("missing metric %v in %v", key, metrics)
+			continue
+		}
+		if got != value {
+			t.Errorf("unexpected value for %v: %v expected %v", key, got, value)
+		}
+	}
+	if len(metrics) != len(expected) {
+		t.Errorf("unexpected metrics: %v", metrics)
+	}
+}
+
+func TestCollectSchemaV1(t *testing.T) {
+	for _, schema := range []string{"", MetricsSchemaV1} {
+		checkMetrics(t, collectSchema(t, schema), map[string]float64{
+			"kubevirt_pod_infra_cpu_seconds_total{type=user} gauge":           12.5,
+			"kubevirt_pod_infra_cpu_seconds_total{type=system} gauge":         3.25,
+			"kubevirt_pod_infra_memory_amount_bytes{type=virtual} gauge":      4096,
+			"kubevirt_pod_infra_memory_amount_bytes{type=resident} gauge":     2048,
+			"kubevirt_pod_infra_memory_amount_bytes{type=shared} gauge":       1024,
+			"kubevirt_pod_infra_memory_amount_bytes{type=dirty} gauge":        512,
+			"kubevirt_pod_infra_io_bytes_total{type=read} counter":            100,
+			"kubevirt_pod_infra_io_bytes_total{type=write} counter":           200,
+			"kubevirt_pod_infra_io_bytes_total{type=cancelled_write} counter": 0,
+			"kubevirt_pod_infra_io_syscalls_total{type=read} counter":         0,
+			"kubevirt_pod_infra_io_syscalls_total{type=write} counter":        0,
+		})
+	}
+}
+
+func TestCollectSchemaV2(t *testing.T) {
+	checkMetrics(t, collectSchema(t, MetricsSchemaV2), map[string]float64{
+		"kubevirt_pod_infra_process_cpu_seconds_total{mode=user} counter":              12.5,
+		"kubevirt_pod_infra_process_cpu_seconds_total{mode=system} counter":            3.25,
+		"kubevirt_pod_infra_process_virtual_memory_bytes{} gauge":                      4096,
+		"kubevirt_pod_infra_process_resident_memory_bytes{} gauge":                     2048,
+		"kubevirt_pod_infra_process_memory_bytes{kind=shared} gauge":                   1024,
+		"kubevirt_pod_infra_process_memory_bytes{kind=dirty} gauge":                    512,
+		"kubevirt_pod_infra_process_io_bytes_total{operation=read} counter":            100,
+		"kubevirt_pod_infra_process_io_bytes_total{operation=write} counter":           200,
+		"kubevirt_pod_infra_process_io_bytes_total{operation=cancelled_write} counter": 0,
+		"kubevirt_pod_infra_process_io_syscalls_total{operation=read} counter":         0,
+		"kubevirt_pod_infra_process_io_syscalls_total{operation=write} counter":        0,
+	})
+}
+
+func TestCollectSchemaV2Labels(t *testing.T) {
+	conf := NewConfig()
+	conf.Hostname = "node0"
+	conf.MetricsSchema = MetricsSchemaV2
+	co := &Collector{conf: conf}
+	pods := fakeSchemaPods()
+	podInfo := pods["virt-launcher-testvm-abcde"]
+
+	m, err := co.newProcessMetric(cpuTimes, 1, podInfo.Meta, podInfo.Samples[0], "user")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	var pb dto.Metric
+	err = m.Write(&pb)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	var labels []string
+	for _, lp := range pb.Label {
+		labels = append(labels, lp.GetName()+"="+lp.GetValue())
+	}
+	expected := "container=,domain=testvm,host=node0,mode=user,namespace=default,pod=virt-launcher-testvm-abcde,pod_uid=4d8ba4be-0b1d-4c5b-a0a5-8d7bfa9c4d30,process=qemu-kvm,qos_class=,vmi=testvm"
+	if strings.Join(labels, ",") != expected {
+		t.Errorf("unexpected labels: %v", labels)
+	}
+}
+
+func TestCollectSchemaGather(t *testing.T) {
+	for _, schema := range []string{MetricsSchemaV1, MetricsSchemaV2} {
+		conf := NewConfig()
+		conf.Hostname = "node0"
+		conf.MetricsSchema = schema
+		reg := prometheus.NewPedanticRegistry()
+		err := reg.Register(Collector{
+			conf: conf,
+			mon:  fakeMonitor{pods: fakeSchemaPods()},
+		})
+		if err != nil {
+			t.Errorf("unexpected error registering schema %v: %v", schema, err)
+			continue
+		}
+		_, err = reg.Gather()
+		if err != nil {
+			t.Errorf("unexpected error gathering schema %v: %v", schema, err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Stages of the collection, as reported by the self-metrics
+const (
+	StageProcScan          = "proc_scan"
+	StageResolvePod        = "resolve_pod"
+	StageCRIListContainers = "cri_list_containers"
+	StageCRIListPods       = "cri_list_pods"
+	StageSampleProcess     = "sample_process"
+	StageUpdate            = "update"
+	StageCollect           = "collect"
+)
+
+// the self-metrics, to alert on a collector which is silently broken
+var (
+	scrapeDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "kubevirt",
+			Subsystem: "pod_infra",
+			Name:      "collector_scrape_duration_seconds",
+			Help:      "Time spent collecting the metrics, seconds.",
+		},
+	)
+	stageDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "kubevirt",
+			Subsystem: "pod_infra",
+			Name:      "collector_stage_duration_seconds",
+			Help:      "Time spent in each stage of the collection, seconds.",
+			Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+		},
+		[]string{"stage"},
+	)
+	stageErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kubevirt",
+			Subsystem: "pod_infra",
+			Name:      "collector_errors_total",
+			Help:      "Errors in each stage of the collection.",
+		},
+		[]string{"stage", "reason"},
+	)
+	matchedProcesses = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "kubevirt",
+			Subsystem: "pod_infra",
+			Name:      "collector_matched_processes",
+			Help:      "Processes matching the configured targets in the last scan.",
+		},
+	)
+	resolvedPods = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "kubevirt",
+			Subsystem: "pod_infra",
+			Name:      "collector_resolved_pods",
+			Help:      "Containers the matching processes were resolved to in the last scan.",
+		},
+	)
+	configReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kubevirt",
+			Subsystem: "pod_infra",
+			Name:      "collector_config_reloads_total",
+			Help:      "Configuration reloads, by result.",
+		},
+		[]string{"result"},
+	)
+	configLastReloadSuccessful = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "kubevirt",
+			Subsystem: "pod_infra",
+			Name:      "collector_config_last_reload_successful",
+			Help:      "Whether the last configuration reload succeeded (1) or not (0).",
+		},
+	)
+	unresolvedPIDs = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "kubevirt",
+			Subsystem: "pod_infra",
+			Name:      "collector_unresolved_pids",
+			Help:      "Processes matching the configured targets which were not resolved to a pod in the last scan, by cgroup classifier.",
+		},
+		[]string{"classifier"},
+	)
+)
+
+// cgroupClassifierNames are the values of the classifier label of unresolvedPIDs
+var cgroupClassifierNames = map[int]string{
+	MissingCGroup:    "missing",
+	MalformedCGroup:  "malformed",
+	UnknownCGroup:    "unknown",
+	DockerCGroup:     "docker",
+	PodCGroup:        "pod",
+	SystemCGroup:     "system",
+	CRIOCGroup:       "crio",
+	CRIOConmonCGroup: "crio_conmon",
+	ContainerdCGroup: "containerd",
+	CgroupfsCGroup:   "cgroupfs",
+}
+
+// cgroupClassifierName returns the name of the given cgroup classifier
+func cgroupClassifierName(classifier int) string {
+	if name, ok := cgroupClassifierNames[classifier]; ok {
+		return name
+	}
+	// added with RegisterCGroupParser
+	for _, parser := range CGroupParsers {
+		if parser.Classifier == classifier {
+			return parser.Name
+		}
+	}
+	return "unknown"
+}
+
+// errorReason classifies the given error with a few, well known, values, to keep the cardinality of stageErrors low
+func errorReason(err error) string {
+	switch {
+	case err == ErrCRIDisconnected, err == ErrCRIClosed:
+		return "disconnected"
+	case os.IsNotExist(err):
+		return "not_found"
+	case os.IsPermission(err):
+		return "permission"
+	}
+	if st, ok := status.FromError(err); ok {
+		switch st.Code() {
+		case codes.DeadlineExceeded:
+			return "timeout"
+		case codes.Unavailable:
+			return "unavailable"
+		case codes.Unimplemented:
+			return "unimplemented"
+		}
+	}
+	if strings.Contains(err.Error(), "timeout") {
+		return "timeout"
+	}
+	return "other"
+}
+
+// countError accounts the given error, if any, in the self-metrics
+func countError(stage string, err error) {
+	if err == nil {
+		return
+	}
+	stageErrors.WithLabelValues(stage, errorReason(err)).Inc()
+}
+
+// observeStage accounts the duration and the outcome of the given stage, begun at start, in the self-metrics
+func observeStage(stage string, start time.Time, err error) {
+	stageDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+	countError(stage, err)
+}
+
+func init() {
+	prometheus.MustRegister(scrapeDuration)
+	prometheus.MustRegister(stageDuration)
+	prometheus.MustRegister(stageErrors)
+	prometheus.MustRegister(matchedProcesses)
+	prometheus.MustRegister(resolvedPods)
+	prometheus.MustRegister(unresolvedPIDs)
+	prometheus.MustRegister(configReloads)
+	prometheus.MustRegister(configLastReloadSuccessful)
+}
@@ -0,0 +1,149 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the pid of no process
+const missingPid = int32(1 << 30)
+
+type partialFinder struct {
+	SelfScanner
+}
+
+func (pf *partialFinder) FindPodByPID(pid int32) (PodMeta, error) {
+	if pid == missingPid {
+		return PodMeta{}, fmt.Errorf("no POD found for pid %v", pid)
+	}
+	return pf.SelfScanner.FindPodByPID(pid)
+}
+
+func metricValue(t *testing.T, m prometheus.Metric) float64 {
+	var pb dto.Metric
+	err := m.Write(&pb)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	switch {
+	case pb.Gauge != nil:
+		return pb.Gauge.GetValue()
+	case pb.Counter != nil:
+		return pb.Counter.GetValue()
+	}
+	t.Fatalf("unexpected metric: %v", pb)
+	return 0
+}
+
+func TestMapProcsToPodsSelfMetrics(t *testing.T) {
+	procs := make(map[string][]int32)
+	procs["self"] = []int32{int32(os.Getpid()), missingPid}
+
+	pods := make(PodMap)
+	_, err := pods.MapProcsToPods(&partialFinder{}, DefaultProcDir, procs)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	if v := metricValue(t, matchedProcesses); v != 2 {
+		t.Errorf("unexpected matched processes: %v", v)
+	}
+	if v := metricValue(t, resolvedPods); v != 1 {
+		t.Errorf("unexpected resolved pods: %v", v)
+	}
+	if v := metricValue(t, unresolvedPIDs.WithLabelValues("missing")); v != 1 {
+		t.Errorf("unexpected unresolved pids: %v", v)
+	}
+}
+
+type unresolvingFinder struct {
+	SelfScanner
+}
+
+func (ff *unresolvingFinder) FindPodByPID(pid int32) (PodMeta, error) {
+	return PodMeta{}, fmt.Errorf("no POD found for pid %v", pid)
+}
+
+func TestMapProcsToPodsProcDir(t *testing.T) {
+	procs := make(map[string][]int32)
+	procs["qemu"] = []int32{4242}
+
+	pods := make(PodMap)
+	_, err := pods.MapProcsToPods(&unresolvingFinder{}, "testdata/proc", procs)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	// classified from testdata/proc/4242/cgroup, not from the host procfs
+	if v := metricValue(t, unresolvedPIDs.WithLabelValues("crio")); v != 1 {
+		t.Errorf("unexpected unresolved pids: %v", v)
+	}
+}
+
+func TestCountError(t *testing.T) {
+	counter := stageErrors.WithLabelValues(StageUpdate, "disconnected")
+	before := metricValue(t, counter)
+	countError(StageUpdate, nil)
+	countError(StageUpdate, ErrCRIDisconnected)
+	if v := metricValue(t, counter); v != before+1 {
+		t.Errorf("unexpected errors: %v (was %v)", v, before)
+	}
+}
+
+func TestErrorReason(t *testing.T) {
+	_, notFound := os.Open("/nonexistent/path")
+	testCases := []struct {
+		err    error
+		reason string
+	}{
+		{ErrCRIDisconnected, "disconnected"},
+		{notFound, "not_found"},
+		{os.ErrPermission, "permission"},
+		{status.Error(codes.DeadlineExceeded, "context deadline exceeded"), "timeout"},
+		{status.Error(codes.Unavailable, "transport is closing"), "unavailable"},
+		{status.Error(codes.Internal, "oops"), "other"},
+		{errors.New("i/o timeout"), "timeout"},
+		{errors.New("malformed stat file"), "other"},
+	}
+	for _, tc := range testCases {
+		if reason := errorReason(tc.err); reason != tc.reason {
+			t.Errorf("unexpected reason for %v: %v expected %v", tc.err, reason, tc.reason)
+		}
+	}
+}
+
+func TestCGroupClassifierName(t *testing.T) {
+	if name := cgroupClassifierName(CRIOConmonCGroup); name != "crio_conmon" {
+		t.Errorf("unexpected name: %v", name)
+	}
+	if name := cgroupClassifierName(1000); name != "unknown" {
+		t.Errorf("unexpected name: %v", name)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DiskSleepState is the name of the uninterruptible sleep state
+const DiskSleepState = "disk_sleep"
+
+// stateNames maps the process states, as found in /proc/PID/stat, to the names we report. See proc(5)
+var stateNames = map[string]string{
+	"R": "running",
+	"S": "sleeping",
+	"D": DiskSleepState,
+	"T": "stopped",
+	"t": "tracing_stop",
+	"Z": "zombie",
+	"X": "dead",
+	"I": "idle",
+	"P": "parked",
+}
+
+// ThreadState is the scheduling state of a thread of a monitored process
+type ThreadState struct {
+	TID   int32
+	Comm  string
+	State string
+	WChan string // where the thread is waiting, if sleeping, and if the kernel discloses it
+	// DiskSleepSince is when the thread was first found in DiskSleepState, and is set by the DomainMonitor
+	// which tracks the states across the refreshes.
+	DiskSleepSince time.Time
+	Stuck          bool // in DiskSleepState for longer than the DomainMonitor HungThreshold
+}
+
+// ProcState is the scheduling state of all the threads of a monitored process
+type ProcState struct {
+	Threads []ThreadState
+}
+
+// Stuck tells if any thread of the process is stuck
+func (ps *ProcState) Stuck() bool {
+	for _, th := range ps.Threads {
+		if th.Stuck {
+			return true
+		}
+	}
+	return false
+}
+
+// SampleState reads the scheduling state of all the threads of the given process.
+// procDir is the path where procfs is mounted (default: /proc)
+// Threads which disappear while being sampled are skipped.
+func SampleState(procDir string, pid int32) (*ProcState, error) {
+	taskDir := filepath.Join(procDir, strconv.Itoa(int(pid)), "task")
+	entries, err := ioutil.ReadDir(taskDir)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := &ProcState{
+		Threads: make([]ThreadState, 0, len(entries)),
+	}
+	for _, entry := range entries {
+		tid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		th, err := readThreadState(filepath.Join(taskDir, entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		th.TID = int32(tid)
+		// the wchan field of stat is always zero since kernel 4.2, so we use the dedicated file
+		wchan, err := ioutil.ReadFile(filepath.Join(taskDir, entry.Name(), "wchan"))
+		if err == nil && string(wchan) != "0" {
+			th.WChan = strings.TrimSpace(string(wchan))
+		}
+		ps.Threads = append(ps.Threads, th)
+	}
+	return ps, nil
+}
+
+// readThreadState parses /proc/PID/task/TID/stat, per proc(5)
+func readThreadState(path string) (ThreadState, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ThreadState{}, err
+	}
+	comm, fields, err := splitStat(string(content))
+	if err != nil || len(fields) < 1 {
+		return ThreadState{}, fmt.Errorf("malformed stat file %s", path)
+	}
+	state, ok := stateNames[fields[0]]
+	if !ok {
+		state = fields[0]
+	}
+	return ThreadState{
+		Comm:  comm,
+		State: state,
+	}, nil
+}
+
+// stateTracker remembers since when each thread is in DiskSleepState, across the refreshes.
+// It is not safe to use it concurrently: the DomainMonitor serializes the refreshes.
+type stateTracker struct {
+	diskSleepSince map[int32]time.Time // by TID
+}
+
+func newStateTracker() *stateTracker {
+	return &stateTracker{
+		diskSleepSince: make(map[int32]time.Time),
+	}
+}
+
+// Update updates the tracked states with the samples of the given pods, and flags the threads
+// in DiskSleepState for longer than threshold. Zero threshold disables the flagging.
+func (st *stateTracker) Update(pods PodInfoMap, threshold time.Duration) {
+	diskSleepSince := make(map[int32]time.Time)
+	for _, podInfo := range pods {
+		for _, sample := range podInfo.Samples {
+			if sample.State == nil {
+				continue
+			}
+			for idx := range sample.State.Threads {
+				th := &sample.State.Threads[idx]
+				if th.State != DiskSleepState {
+					continue
+				}
+				since, ok := st.diskSleepSince[th.TID]
+				if !ok {
+					since = sample.Timestamp
+				}
+				diskSleepSince[th.TID] = since
+				th.DiskSleepSince = since
+				th.Stuck = threshold > 0 && sample.Timestamp.Sub(since) > threshold
+			}
+		}
+	}
+	// threads which woke up, or are gone, are forgotten
+	st.diskSleepSince = diskSleepSince
+}
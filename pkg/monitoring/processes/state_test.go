@@ -0,0 +1,144 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSampleState(t *testing.T) {
+	ps, err := SampleState("testdata/proc", 4242)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if len(ps.Threads) != 6 {
+		t.Errorf("unexpected threads: %#v", ps.Threads)
+		return
+	}
+	for _, th := range ps.Threads {
+		switch th.TID {
+		case 4253:
+			if th.State != DiskSleepState || th.WChan != "rpc_wait_bit_killable" {
+				t.Errorf("unexpected thread state: %#v", th)
+			}
+		case 4250:
+			if th.State != "sleeping" || th.WChan != "" || th.Comm != "CPU 0/KVM" {
+				t.Errorf("unexpected thread state: %#v", th)
+			}
+		}
+	}
+	if ps.Stuck() {
+		t.Errorf("unexpected stuck process")
+	}
+}
+
+func TestSampleStateMissing(t *testing.T) {
+	_, err := SampleState("testdata/proc", 4444)
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func sampleStatePods(t *testing.T, timestamp time.Time) PodInfoMap {
+	ps, err := SampleState("testdata/proc", 4242)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return PodInfoMap{
+		"vm": &PodInfo{
+			Samples: []*ProcSample{
+				{PID: 4242, Timestamp: timestamp, State: ps},
+			},
+		},
+	}
+}
+
+func findThreadState(pods PodInfoMap, tid int32) ThreadState {
+	for _, th := range pods["vm"].Samples[0].State.Threads {
+		if th.TID == tid {
+			return th
+		}
+	}
+	return ThreadState{}
+}
+
+func TestStateTrackerFlagsStuckThreads(t *testing.T) {
+	st := newStateTracker()
+	start := time.Now()
+	threshold := 10 * time.Second
+
+	pods := sampleStatePods(t, start)
+	st.Update(pods, threshold)
+	th := findThreadState(pods, 4253)
+	if th.Stuck || !th.DiskSleepSince.Equal(start) {
+		t.Errorf("unexpected thread state: %#v", th)
+	}
+
+	pods = sampleStatePods(t, start.Add(5*time.Second))
+	st.Update(pods, threshold)
+	if findThreadState(pods, 4253).Stuck {
+		t.Errorf("unexpected stuck thread before the threshold")
+	}
+
+	pods = sampleStatePods(t, start.Add(11*time.Second))
+	st.Update(pods, threshold)
+	th = findThreadState(pods, 4253)
+	if !th.Stuck || !th.DiskSleepSince.Equal(start) {
+		t.Errorf("unexpected thread state: %#v", th)
+	}
+	if !pods["vm"].Samples[0].State.Stuck() {
+		t.Errorf("unexpected not stuck process")
+	}
+	if findThreadState(pods, 4250).Stuck {
+		t.Errorf("unexpected stuck sleeping thread")
+	}
+}
+
+func TestStateTrackerForgetsWokenThreads(t *testing.T) {
+	st := newStateTracker()
+	start := time.Now()
+
+	pods := sampleStatePods(t, start)
+	st.Update(pods, time.Second)
+
+	// the thread woke up meanwhile
+	st.Update(PodInfoMap{}, time.Second)
+
+	pods = sampleStatePods(t, start.Add(time.Minute))
+	st.Update(pods, time.Second)
+	th := findThreadState(pods, 4253)
+	if th.Stuck || !th.DiskSleepSince.Equal(start.Add(time.Minute)) {
+		t.Errorf("unexpected thread state: %#v", th)
+	}
+}
+
+func TestStateTrackerDisabled(t *testing.T) {
+	st := newStateTracker()
+	start := time.Now()
+
+	st.Update(sampleStatePods(t, start), 0)
+	pods := sampleStatePods(t, start.Add(time.Hour))
+	st.Update(pods, 0)
+	if findThreadState(pods, 4253).Stuck {
+		t.Errorf("unexpected stuck thread")
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+// Thread classes, following the libvirt tuning terminology
+const (
+	VCPUThread     = "vcpu"
+	IOThread       = "iothread"
+	EmulatorThread = "emulator" // anything else: main loop, workers, migration...
+)
+
+// ThreadSample is a point-in-time measurement of a thread of a monitored process
+type ThreadSample struct {
+	TID    int32
+	Comm   string
+	Class  string
+	VCPU   int // vCPU index, -1 unless Class is VCPUThread
+	User   float64
+	System float64
+}
+
+// SampleThreads measures all the threads of the given process.
+// procDir is the path where procfs is mounted (default: /proc)
+// Threads which disappear while being sampled are skipped.
+func SampleThreads(procDir string, pid int32) ([]ThreadSample, error) {
+	taskDir := filepath.Join(procDir, strconv.Itoa(int(pid)), "task")
+	entries, err := ioutil.ReadDir(taskDir)
+	if err != nil {
+		return nil, err
+	}
+
+	threads := make([]ThreadSample, 0, len(entries))
+	for _, entry := range entries {
+		tid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		th, err := readThreadStat(filepath.Join(taskDir, entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		th.TID = int32(tid)
+		th.Class, th.VCPU = ClassifyThread(th.Comm)
+		threads = append(threads, th)
+	}
+	return threads, nil
+}
+
+// ClassifyThread classifies a qemu thread by its name. Returns the class and,
+// for vCPU threads only, the vCPU index (-1 otherwise).
+// qemu names the vCPU threads "CPU $N/KVM" and the iothreads "IO $ID".
+func ClassifyThread(comm string) (string, int) {
+	if strings.HasPrefix(comm, "CPU ") {
+		items := strings.SplitN(comm[len("CPU "):], "/", 2)
+		if idx, err := strconv.Atoi(items[0]); err == nil {
+			return VCPUThread, idx
+		}
+	}
+	if strings.HasPrefix(comm, "IO ") {
+		return IOThread, -1
+	}
+	return EmulatorThread, -1
+}
+
+// readThreadStat parses /proc/PID/task/TID/stat, per proc(5)
+func readThreadStat(path string) (ThreadSample, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ThreadSample{}, err
+	}
+	comm, fields, err := splitStat(string(content))
+	if err != nil {
+		return ThreadSample{}, fmt.Errorf("malformed stat file %s", path)
+	}
+	// fields[0] is the field #3 (state); utime is #14, stime is #15
+	if len(fields) < 13 {
+		return ThreadSample{}, fmt.Errorf("truncated stat file %s", path)
+	}
+	utime, err := strconv.ParseFloat(fields[11], 64)
+	if err != nil {
+		return ThreadSample{}, err
+	}
+	stime, err := strconv.ParseFloat(fields[12], 64)
+	if err != nil {
+		return ThreadSample{}, err
+	}
+	return ThreadSample{
+		Comm:   comm,
+		User:   utime / process.ClockTicks,
+		System: stime / process.ClockTicks,
+	}, nil
+}
+
+// splitStat splits the content of a stat file in the comm - field #2 - and the fields after it
+func splitStat(data string) (string, []string, error) {
+	// the comm may contain spaces and parens, so we look for the outermost ones
+	start := strings.IndexByte(data, '(')
+	end := strings.LastIndexByte(data, ')')
+	if start < 0 || end < start {
+		return "", nil, fmt.Errorf("missing comm")
+	}
+	return data[start+1 : end], strings.Fields(data[end+1:]), nil
+}
@@ -0,0 +1,159 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package processes
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestClassifyThread(t *testing.T) {
+	testCases := []struct {
+		comm  string
+		class string
+		vcpu  int
+	}{
+		{"CPU 0/KVM", VCPUThread, 0},
+		{"CPU 12/KVM", VCPUThread, 12},
+		{"IO iothread1", IOThread, -1},
+		{"qemu-kvm", EmulatorThread, -1},
+		{"worker", EmulatorThread, -1},
+		{"CPU hotplug", EmulatorThread, -1},
+	}
+	for _, tc := range testCases {
+		class, vcpu := ClassifyThread(tc.comm)
+		if class != tc.class || vcpu != tc.vcpu {
+			t.Errorf("%q: unexpected classification: %v %v", tc.comm, class, vcpu)
+		}
+	}
+}
+
+func TestSampleThreads(t *testing.T) {
+	threads, err := SampleThreads("testdata/proc", 4242)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if len(threads) != 6 {
+		t.Errorf("unexpected threads: %#v", threads)
+		return
+	}
+	for _, th := range threads {
+		if th.TID == 4251 {
+			if th.Comm != "CPU 1/KVM" || th.Class != VCPUThread || th.VCPU != 1 {
+				t.Errorf("unexpected thread: %#v", th)
+			}
+			if th.User != 8.0 || th.System != 1.0 {
+				t.Errorf("unexpected times: %#v", th)
+			}
+		}
+		if th.TID == 4254 && th.Comm != "SPICE (Worker)" {
+			t.Errorf("unexpected thread: %#v", th)
+		}
+	}
+}
+
+func TestSampleThreadsMissingProcess(t *testing.T) {
+	_, err := SampleThreads("testdata/proc", 1)
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestGroupThreads(t *testing.T) {
+	threads, err := SampleThreads("testdata/proc", 4242)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	groups := groupThreads(threads, ThreadMetricsClass)
+	if len(groups) != 3 {
+		t.Errorf("unexpected groups: %#v", groups)
+	}
+	for _, group := range groups {
+		if group.VCPU != "" {
+			t.Errorf("unexpected vCPU in group: %#v", group)
+		}
+		if group.Class == VCPUThread && group.User != 18.0 {
+			t.Errorf("unexpected vCPU times: %#v", group)
+		}
+		if group.Class == EmulatorThread && math.Abs(group.User-1.65) > 1e-9 {
+			t.Errorf("unexpected emulator times: %#v", group)
+		}
+	}
+
+	groups = groupThreads(threads, ThreadMetricsVCPU)
+	if len(groups) != 4 {
+		t.Errorf("unexpected groups: %#v", groups)
+	}
+}
+
+func TestCollectThreadsGauge(t *testing.T) {
+	for schema, name := range map[string]string{
+		MetricsSchemaV1: "kubevirt_pod_infra_thread_cpu_seconds",
+		MetricsSchemaV2: "kubevirt_pod_infra_process_thread_cpu_seconds",
+	} {
+		conf := NewConfig()
+		conf.ThreadMetrics = ThreadMetricsClass
+		conf.MetricsSchema = schema
+		co := &Collector{conf: conf}
+		podInfo := fakeSchemaPods()["virt-launcher-testvm-abcde"]
+		sample := podInfo.Samples[0]
+		var err error
+		sample.Threads, err = SampleThreads("testdata/proc", 4242)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+
+		ch := make(chan prometheus.Metric, 16)
+		err = co.collectThreads(ch, podInfo.Meta, sample)
+		close(ch)
+		if err != nil {
+			t.Errorf("unexpected error for schema %v: %v", schema, err)
+			continue
+		}
+		count := 0
+		for m := range ch {
+			// the sum over the live threads decreases when threads exit: it cannot be a counter
+			if !strings.Contains(m.Desc().String(), `"`+name+`"`) {
+				t.Errorf("unexpected metric for schema %v: %v", schema, m.Desc())
+			}
+			var pb dto.Metric
+			err = m.Write(&pb)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if pb.Gauge == nil {
+				t.Errorf("unexpected type for schema %v: %v", schema, pb.String())
+			}
+			count++
+		}
+		if count != 6 {
+			t.Errorf("unexpected metrics count for schema %v: %v", schema, count)
+		}
+	}
+}
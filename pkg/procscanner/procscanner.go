@@ -109,6 +109,58 @@ func readProcCmdline(pathname string) []string {
 	return argv
 }
 
+// VhostPrefix is the name prefix of the vhost kernel threads, which are named after the PID
+// of the process which owns them - usually qemu: vhost-$PID.
+const VhostPrefix = "vhost-"
+
+// ScanVhost scans the Linux procfs to find the vhost kernel threads.
+// basePath is the path where procfs is mounted (default: /proc)
+// returns a map whose keys are the PIDs of the owners, and whose values are an unordered list of
+// the PIDs of the vhost kernel threads serving them.
+// Since kernel 6.4 the vhost workers are threads of their owner, hence they are not found here,
+// and they are accounted to their owner already.
+func ScanVhost(basePath string) (map[int32][]int32, error) {
+	res := make(map[int32][]int32)
+
+	procEntries, err := filepath.Glob(path.Join(basePath, "*", "comm"))
+	if err != nil {
+		return res, err
+	}
+
+	for _, procEntry := range procEntries {
+		content, err := ioutil.ReadFile(procEntry)
+		if err != nil {
+			continue // gone meanwhile
+		}
+		owner, ok := ParseVhostName(strings.TrimSpace(string(content)))
+		if !ok {
+			continue
+		}
+
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(procEntry)))
+		if err != nil {
+			continue
+		}
+
+		res[owner] = append(res[owner], int32(pid))
+	}
+
+	return res, nil
+}
+
+// ParseVhostName returns the PID of the owner of the vhost kernel thread with the given name,
+// and false if the name is not the one of a vhost kernel thread.
+func ParseVhostName(comm string) (int32, bool) {
+	if !strings.HasPrefix(comm, VhostPrefix) {
+		return 0, false
+	}
+	owner, err := strconv.Atoi(comm[len(VhostPrefix):])
+	if err != nil || owner <= 0 {
+		return 0, false
+	}
+	return int32(owner), true
+}
+
 // MatchArgv matches two commanddlines.
 // Return error iff the normalization of the commandline fails.
 func MatchArgv(argv, model []string) (bool, error) {
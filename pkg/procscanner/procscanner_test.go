@@ -60,3 +60,44 @@ func TestScanWithoutGlob(t *testing.T) {
 		t.Errorf("Unexpected pids: %#v", pids)
 	}
 }
+
+func TestScanVhost(t *testing.T) {
+	ret, err := ScanVhost("testdata/proc")
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+		return
+	}
+	if len(ret) != 1 {
+		t.Errorf("Unexpected results: %#v", ret)
+		return
+	}
+	pids, ok := ret[3000]
+	if !ok {
+		t.Errorf("vhost threads of 3000 not found: %#v", ret)
+		return
+	}
+	if len(pids) != 2 || pids[0] != 3010 || pids[1] != 3011 {
+		t.Errorf("Unexpected pids: %#v", pids)
+	}
+}
+
+func TestParseVhostName(t *testing.T) {
+	testCases := []struct {
+		comm  string
+		owner int32
+		ok    bool
+	}{
+		{"vhost-3000", 3000, true},
+		{"vhost-", 0, false},
+		{"vhost-net", 0, false},
+		{"vhost--1", 0, false},
+		{"kworker/1:0", 0, false},
+		{"qemu-kvm", 0, false},
+	}
+	for _, tc := range testCases {
+		owner, ok := ParseVhostName(tc.comm)
+		if owner != tc.owner || ok != tc.ok {
+			t.Errorf("Unexpected result for %q: %v %v", tc.comm, owner, ok)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package qmp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// GuestAgentChannel is the name of the virtio-serial port the qemu guest agent listens on by default.
+// libvirt owns this channel, and the agent serves only one client at a time.
+const GuestAgentChannel = "org.qemu.guest_agent.0"
+
+// MetricsAgentChannel is the name of the virtio-serial port dedicated to the metrics collection,
+// on which a second instance of the guest agent must listen, e.g. qemu-ga -p /dev/virtio-ports/org.qemu.guest_agent.metrics
+const MetricsAgentChannel = "org.qemu.guest_agent.metrics"
+
+// Agent is a client for the qemu guest agent, which speaks the QMP wire protocol, without greeting
+// nor events. See https://www.qemu.org/docs/master/interop/qemu-ga-ref.html
+type Agent struct {
+	*channel
+}
+
+// DialAgent connects to the guest agent unix socket at the given path, and synchronizes with the agent.
+func DialAgent(path string, timeout time.Duration) (*Agent, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	a, err := NewAgent(conn, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// NewAgent synchronizes with the agent on the given connection.
+// On success, the Agent owns the connection.
+func NewAgent(conn net.Conn, timeout time.Duration) (*Agent, error) {
+	a := &Agent{
+		channel: newChannel(conn, timeout),
+	}
+	err := a.sync()
+	if err != nil {
+		return nil, fmt.Errorf("error synchronizing with the guest agent: %v", err)
+	}
+	return a, nil
+}
+
+// sync discards the stale responses a previous client may have left in the channel,
+// which outlives the connections, as the qemu-ga documentation recommends.
+func (a *Agent) sync() error {
+	id := rand.Int63n(1 << 31)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.setDeadline()
+	err := a.enc.Encode(Command{Execute: "guest-sync", Arguments: map[string]int64{"id": id}})
+	if err != nil {
+		return err
+	}
+	for {
+		var resp struct {
+			Return *int64 `json:"return"`
+			Error  *Error `json:"error"`
+		}
+		err = a.dec.Decode(&resp)
+		if err != nil {
+			return err
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if resp.Return != nil && *resp.Return == id {
+			return nil
+		}
+	}
+}
+
+// Ping checks the agent is responsive
+func (a *Agent) Ping() error {
+	return a.Execute("guest-ping", nil, nil)
+}
+
+// OSInfo is the guest-get-osinfo output
+type OSInfo struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	PrettyName    string `json:"pretty-name"`
+	Version       string `json:"version"`
+	VersionID     string `json:"version-id"`
+	KernelRelease string `json:"kernel-release"`
+	KernelVersion string `json:"kernel-version"`
+	Machine       string `json:"machine"`
+}
+
+// OSInfo runs guest-get-osinfo
+func (a *Agent) OSInfo() (OSInfo, error) {
+	var ret OSInfo
+	err := a.Execute("guest-get-osinfo", nil, &ret)
+	return ret, err
+}
+
+// FSInfo is an item of the guest-get-fsinfo output. Only the fields we use are decoded.
+type FSInfo struct {
+	Name       string  `json:"name"`
+	MountPoint string  `json:"mountpoint"`
+	Type       string  `json:"type"`
+	UsedBytes  *uint64 `json:"used-bytes"`  // requires qemu-ga >= 5.0
+	TotalBytes *uint64 `json:"total-bytes"` // requires qemu-ga >= 5.0
+}
+
+// FSInfo runs guest-get-fsinfo
+func (a *Agent) FSInfo() ([]FSInfo, error) {
+	var ret []FSInfo
+	err := a.Execute("guest-get-fsinfo", nil, &ret)
+	return ret, err
+}
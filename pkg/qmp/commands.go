@@ -0,0 +1,161 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package qmp
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// BlockStats is an item of the query-blockstats output. Only the fields we use are decoded.
+type BlockStats struct {
+	Device string `json:"device"`
+	QDev   string `json:"qdev"`
+	Stats  struct {
+		ReadBytes        uint64 `json:"rd_bytes"`
+		WriteBytes       uint64 `json:"wr_bytes"`
+		ReadOperations   uint64 `json:"rd_operations"`
+		WriteOperations  uint64 `json:"wr_operations"`
+		FlushOperations  uint64 `json:"flush_operations"`
+		ReadTotalTimeNS  uint64 `json:"rd_total_time_ns"`
+		WriteTotalTimeNS uint64 `json:"wr_total_time_ns"`
+		FlushTotalTimeNS uint64 `json:"flush_total_time_ns"`
+	} `json:"stats"`
+}
+
+// Name returns the name of the drive: libvirt sets the device only for legacy drives, and the qdev otherwise
+func (bs BlockStats) Name() string {
+	if bs.Device != "" {
+		return bs.Device
+	}
+	// /machine/peripheral/virtio-disk0/virtio-backend
+	items := strings.Split(bs.QDev, "/")
+	if len(items) >= 4 && items[1] == "machine" && items[2] == "peripheral" {
+		return items[3]
+	}
+	return bs.QDev
+}
+
+// QueryBlockStats runs query-blockstats
+func (c *Client) QueryBlockStats() ([]BlockStats, error) {
+	var ret []BlockStats
+	err := c.Execute("query-blockstats", nil, &ret)
+	return ret, err
+}
+
+// BalloonInfo is the query-balloon output
+type BalloonInfo struct {
+	Actual uint64 `json:"actual"` // bytes
+}
+
+// QueryBalloon runs query-balloon. Fails with DeviceNotActive if the VM has no balloon
+func (c *Client) QueryBalloon() (BalloonInfo, error) {
+	var ret BalloonInfo
+	err := c.Execute("query-balloon", nil, &ret)
+	return ret, err
+}
+
+// CPUInfo is an item of the query-cpus-fast output
+type CPUInfo struct {
+	CPUIndex int    `json:"cpu-index"`
+	QOMPath  string `json:"qom-path"`
+	ThreadID int    `json:"thread-id"`
+}
+
+// QueryCPUsFast runs query-cpus-fast
+func (c *Client) QueryCPUsFast() ([]CPUInfo, error) {
+	var ret []CPUInfo
+	err := c.Execute("query-cpus-fast", nil, &ret)
+	return ret, err
+}
+
+// Stats targets, see query-stats
+const (
+	StatsTargetVM   = "vm"
+	StatsTargetVCPU = "vcpu"
+)
+
+// Stat is a single statistic. Value is nil unless the statistic is a number: histograms are not decoded.
+type Stat struct {
+	Name  string          `json:"name"`
+	Raw   json.RawMessage `json:"value"`
+	Value *float64        `json:"-"`
+}
+
+// StatsResult is an item of the query-stats output: the statistics of a provider for an object
+type StatsResult struct {
+	Provider string `json:"provider"`
+	QOMPath  string `json:"qom-path"` // only for the vcpu target
+	Stats    []Stat `json:"stats"`
+}
+
+// QueryStats runs query-stats for the given target. Requires qemu >= 7.1
+func (c *Client) QueryStats(target string) ([]StatsResult, error) {
+	var ret []StatsResult
+	err := c.Execute("query-stats", map[string]string{"target": target}, &ret)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range ret {
+		for idx := range res.Stats {
+			stat := &res.Stats[idx]
+			value, err := strconv.ParseFloat(string(stat.Raw), 64)
+			if err == nil {
+				stat.Value = &value
+			}
+		}
+	}
+	return ret, nil
+}
+
+// MigrationRAMStats is the RAM section of the query-migrate output
+type MigrationRAMStats struct {
+	Transferred    uint64  `json:"transferred"` // bytes
+	Remaining      uint64  `json:"remaining"`   // bytes
+	Total          uint64  `json:"total"`       // bytes
+	DirtyPagesRate float64 `json:"dirty-pages-rate"`
+	DirtySyncCount uint64  `json:"dirty-sync-count"` // number of iterations over the guest memory
+	PageSize       uint64  `json:"page-size"`        // bytes
+	MBPS           float64 `json:"mbps"`
+}
+
+// MigrationInfo is the query-migrate output
+type MigrationInfo struct {
+	Status           string             `json:"status"`
+	ExpectedDowntime uint64             `json:"expected-downtime"` // milliseconds, only while active
+	RAM              *MigrationRAMStats `json:"ram"`               // nil if no migration ever started
+}
+
+// InProgress tells if the migration is still running, as opposed to not started, completed or failed
+func (mi MigrationInfo) InProgress() bool {
+	switch mi.Status {
+	case "setup", "active", "postcopy-active", "postcopy-paused", "postcopy-recover", "pre-switchover", "device", "wait-unplug":
+		return true
+	}
+	return false
+}
+
+// QueryMigrate runs query-migrate
+func (c *Client) QueryMigrate() (MigrationInfo, error) {
+	var ret MigrationInfo
+	err := c.Execute("query-migrate", nil, &ret)
+	return ret, err
+}
@@ -0,0 +1,181 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+// Package qmp implements a minimal client for the QEMU Machine Protocol (QMP),
+// the JSON protocol qemu speaks on its monitor sockets.
+// See https://www.qemu.org/docs/master/interop/qmp-spec.html
+package qmp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Version is the qemu version, as reported in the QMP greeting
+type Version struct {
+	QEMU struct {
+		Major int `json:"major"`
+		Minor int `json:"minor"`
+		Micro int `json:"micro"`
+	} `json:"qemu"`
+	Package string `json:"package"`
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.QEMU.Major, v.QEMU.Minor, v.QEMU.Micro)
+}
+
+// Greeting is the message qemu sends as soon as a client connects
+type Greeting struct {
+	QMP struct {
+		Version      Version  `json:"version"`
+		Capabilities []string `json:"capabilities"`
+	} `json:"QMP"`
+}
+
+// Error is an error reported by qemu in response to a command
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("QMP error %s: %s", e.Class, e.Desc)
+}
+
+// Command is a QMP command, as sent on the wire
+type Command struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+// Response is any message sent by qemu after the greeting: either a command outcome or an event
+type Response struct {
+	Return json.RawMessage `json:"return,omitempty"`
+	Error  *Error          `json:"error,omitempty"`
+	Event  string          `json:"event,omitempty"`
+}
+
+// channel is a connection speaking the QMP wire protocol, which the guest agent speaks too.
+// It is safe to use it concurrently, but the commands are serialized.
+type channel struct {
+	timeout time.Duration // for each command; zero means no timeout
+	lock    sync.Mutex    // protects all the fields below
+	conn    net.Conn
+	dec     *json.Decoder
+	enc     *json.Encoder
+}
+
+func newChannel(conn net.Conn, timeout time.Duration) *channel {
+	return &channel{
+		timeout: timeout,
+		conn:    conn,
+		dec:     json.NewDecoder(conn),
+		enc:     json.NewEncoder(conn),
+	}
+}
+
+// Execute runs the given command, with the given arguments (may be nil), and decodes the
+// returned value in result (may be nil). The asynchronous events are discarded.
+func (ch *channel) Execute(cmd string, args interface{}, result interface{}) error {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	ch.setDeadline()
+	err := ch.enc.Encode(Command{Execute: cmd, Arguments: args})
+	if err != nil {
+		return err
+	}
+
+	for {
+		var resp Response
+		err = ch.dec.Decode(&resp)
+		if err != nil {
+			return err
+		}
+		if resp.Event != "" {
+			continue
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil || resp.Return == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Return, result)
+	}
+}
+
+// Close terminates the connection
+func (ch *channel) Close() error {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	return ch.conn.Close()
+}
+
+func (ch *channel) setDeadline() {
+	if ch.timeout > 0 {
+		ch.conn.SetDeadline(time.Now().Add(ch.timeout))
+	}
+}
+
+// Client is a QMP client. It is safe to use it concurrently, but the commands are serialized.
+type Client struct {
+	*channel
+	Version Version
+}
+
+// Dial connects to the QMP unix socket at the given path, and negotiates the capabilities.
+func Dial(path string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(conn, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient runs the QMP handshake on the given connection.
+// On success, the Client owns the connection.
+func NewClient(conn net.Conn, timeout time.Duration) (*Client, error) {
+	c := &Client{
+		channel: newChannel(conn, timeout),
+	}
+
+	c.setDeadline()
+	var greeting Greeting
+	err := c.dec.Decode(&greeting)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the QMP greeting: %v", err)
+	}
+	c.Version = greeting.QMP.Version
+
+	err = c.Execute("qmp_capabilities", nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error negotiating the QMP capabilities: %v", err)
+	}
+	return c, nil
+}
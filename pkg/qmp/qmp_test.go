@@ -0,0 +1,334 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package qmp_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/pkg/qmp"
+	"github.com/fromanirh/kubevirt-metrics-collector/pkg/qmp/qmptest"
+)
+
+func newServerAndClient(t *testing.T) (*qmptest.Server, *qmp.Client) {
+	srv, err := qmptest.NewServer()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	srv.Events = []string{"RTC_CHANGE"}
+	srv.Returns["query-blockstats"] = []map[string]interface{}{
+		{
+			"device": "",
+			"qdev":   "/machine/peripheral/virtio-disk0/virtio-backend",
+			"stats": map[string]interface{}{
+				"rd_bytes":         4096,
+				"wr_bytes":         8192,
+				"rd_operations":    1,
+				"wr_operations":    2,
+				"flush_operations": 3,
+				"rd_total_time_ns": 1000000,
+			},
+		},
+	}
+	srv.Returns["query-balloon"] = map[string]interface{}{"actual": 1073741824}
+	srv.Returns["query-stats"] = []map[string]interface{}{
+		{
+			"provider": "kvm",
+			"qom-path": "/machine/unattached/device[0]",
+			"stats": []map[string]interface{}{
+				{"name": "halt_wait_ns", "value": 123456},
+				{"name": "halt_wait_hist", "value": []int{1, 2, 3}},
+				{"name": "guest_mode", "value": true},
+			},
+		},
+	}
+	srv.Errors["query-cpus-fast"] = &qmp.Error{Class: "GenericError", Desc: "nope"}
+
+	c, err := qmp.Dial(srv.Path(), time.Second)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return srv, c
+}
+
+func TestDialNegotiates(t *testing.T) {
+	srv, c := newServerAndClient(t)
+	defer srv.Close()
+	defer c.Close()
+
+	if c.Version.String() != "4.2.0" {
+		t.Errorf("unexpected version: %v", c.Version)
+	}
+	cmds := srv.Commands()
+	if len(cmds) != 1 || cmds[0].Execute != "qmp_capabilities" {
+		t.Errorf("unexpected commands: %#v", cmds)
+	}
+}
+
+func TestDialInexistent(t *testing.T) {
+	_, err := qmp.Dial("/inexistent/qmp.sock", time.Second)
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestQueryBlockStats(t *testing.T) {
+	srv, c := newServerAndClient(t)
+	defer srv.Close()
+	defer c.Close()
+
+	stats, err := c.QueryBlockStats()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if len(stats) != 1 {
+		t.Errorf("unexpected stats: %#v", stats)
+		return
+	}
+	if stats[0].Name() != "virtio-disk0" {
+		t.Errorf("unexpected name: %v", stats[0].Name())
+	}
+	if stats[0].Stats.ReadBytes != 4096 || stats[0].Stats.FlushOperations != 3 {
+		t.Errorf("unexpected stats: %#v", stats[0].Stats)
+	}
+}
+
+func TestQueryBalloon(t *testing.T) {
+	srv, c := newServerAndClient(t)
+	defer srv.Close()
+	defer c.Close()
+
+	info, err := c.QueryBalloon()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if info.Actual != 1073741824 {
+		t.Errorf("unexpected balloon: %#v", info)
+	}
+}
+
+func TestQueryStats(t *testing.T) {
+	srv, c := newServerAndClient(t)
+	defer srv.Close()
+	defer c.Close()
+
+	results, err := c.QueryStats(qmp.StatsTargetVCPU)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if len(results) != 1 || len(results[0].Stats) != 3 {
+		t.Errorf("unexpected results: %#v", results)
+		return
+	}
+	stats := results[0].Stats
+	if stats[0].Value == nil || *stats[0].Value != 123456 {
+		t.Errorf("unexpected value: %#v", stats[0])
+	}
+	if stats[1].Value != nil || stats[2].Value != nil {
+		t.Errorf("unexpected non-numeric values: %#v %#v", stats[1], stats[2])
+	}
+	cmds := srv.Commands()
+	last := cmds[len(cmds)-1]
+	args, ok := last.Arguments.(map[string]interface{})
+	if !ok || args["target"] != qmp.StatsTargetVCPU {
+		t.Errorf("unexpected command: %#v", last)
+	}
+}
+
+func TestExecuteError(t *testing.T) {
+	srv, c := newServerAndClient(t)
+	defer srv.Close()
+	defer c.Close()
+
+	_, err := c.QueryCPUsFast()
+	qmpErr, ok := err.(*qmp.Error)
+	if !ok || qmpErr.Class != "GenericError" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// the connection must still be usable
+	_, err = c.QueryBalloon()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExecuteUnknownCommand(t *testing.T) {
+	srv, c := newServerAndClient(t)
+	defer srv.Close()
+	defer c.Close()
+
+	err := c.Execute("query-inexistent", nil, nil)
+	qmpErr, ok := err.(*qmp.Error)
+	if !ok || qmpErr.Class != "CommandNotFound" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestQueryMigrate(t *testing.T) {
+	srv, c := newServerAndClient(t)
+	defer srv.Close()
+	defer c.Close()
+
+	srv.SetReturn("query-migrate", map[string]interface{}{
+		"status":            "active",
+		"expected-downtime": 300,
+		"ram": map[string]interface{}{
+			"transferred":      1073741824,
+			"remaining":        536870912,
+			"total":            2147483648,
+			"dirty-pages-rate": 2500,
+			"dirty-sync-count": 3,
+			"page-size":        4096,
+		},
+	})
+	info, err := c.QueryMigrate()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if !info.InProgress() || info.ExpectedDowntime != 300 {
+		t.Errorf("unexpected info: %#v", info)
+	}
+	if info.RAM == nil || info.RAM.Remaining != 536870912 || info.RAM.DirtySyncCount != 3 {
+		t.Errorf("unexpected RAM stats: %#v", info.RAM)
+	}
+}
+
+func TestMigrationInProgress(t *testing.T) {
+	testCases := []struct {
+		status   string
+		expected bool
+	}{
+		{"", false},
+		{"none", false},
+		{"setup", true},
+		{"active", true},
+		{"postcopy-active", true},
+		{"completed", false},
+		{"failed", false},
+		{"cancelled", false},
+	}
+	for _, tc := range testCases {
+		mi := qmp.MigrationInfo{Status: tc.status}
+		if mi.InProgress() != tc.expected {
+			t.Errorf("unexpected outcome for status %q", tc.status)
+		}
+	}
+}
+
+func newAgentServerAndClient(t *testing.T) (*qmptest.Server, *qmp.Agent) {
+	srv, err := qmptest.NewAgentServer()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// stale data left by a previous client
+	srv.Events = []string{"STALE"}
+	srv.Returns["guest-ping"] = struct{}{}
+	srv.Returns["guest-get-osinfo"] = map[string]interface{}{
+		"id":             "fedora",
+		"name":           "Fedora",
+		"version-id":     "30",
+		"kernel-release": "5.0.9-301.fc30.x86_64",
+		"machine":        "x86_64",
+	}
+	srv.Returns["guest-get-fsinfo"] = []map[string]interface{}{
+		{"name": "vda1", "mountpoint": "/", "type": "xfs", "used-bytes": 1073741824, "total-bytes": 4294967296},
+		{"name": "vdb", "mountpoint": "/data", "type": "ext4"},
+	}
+
+	a, err := qmp.DialAgent(srv.Path(), time.Second)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return srv, a
+}
+
+func TestDialAgentSyncs(t *testing.T) {
+	srv, a := newAgentServerAndClient(t)
+	defer srv.Close()
+	defer a.Close()
+
+	cmds := srv.Commands()
+	if len(cmds) != 1 || cmds[0].Execute != "guest-sync" {
+		t.Errorf("unexpected commands: %#v", cmds)
+	}
+	err := a.Ping()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDialAgentNotResponding(t *testing.T) {
+	srv, err := qmptest.NewAgentServer()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	defer srv.Close()
+	srv.Errors["guest-sync"] = &qmp.Error{Class: "GenericError", Desc: "guest agent not connected"}
+
+	_, err = qmp.DialAgent(srv.Path(), time.Second)
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestAgentOSInfo(t *testing.T) {
+	srv, a := newAgentServerAndClient(t)
+	defer srv.Close()
+	defer a.Close()
+
+	info, err := a.OSInfo()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if info.ID != "fedora" || info.VersionID != "30" || info.KernelRelease != "5.0.9-301.fc30.x86_64" {
+		t.Errorf("unexpected OS info: %#v", info)
+	}
+}
+
+func TestAgentFSInfo(t *testing.T) {
+	srv, a := newAgentServerAndClient(t)
+	defer srv.Close()
+	defer a.Close()
+
+	fss, err := a.FSInfo()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if len(fss) != 2 {
+		t.Errorf("unexpected filesystems: %#v", fss)
+		return
+	}
+	if fss[0].UsedBytes == nil || *fss[0].UsedBytes != 1073741824 || fss[0].MountPoint != "/" {
+		t.Errorf("unexpected filesystem: %#v", fss[0])
+	}
+	if fss[1].UsedBytes != nil || fss[1].TotalBytes != nil {
+		t.Errorf("unexpected filesystem: %#v", fss[1])
+	}
+}
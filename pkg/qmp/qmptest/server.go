@@ -0,0 +1,176 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+// Package qmptest provides a fake QMP server, for testing the QMP clients.
+package qmptest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fromanirh/kubevirt-metrics-collector/pkg/qmp"
+)
+
+// Server is a fake qemu, which answers the QMP commands with canned responses
+type Server struct {
+	// Returns maps the command names to the values to return.
+	// Once a client connected, use SetReturn instead.
+	Returns map[string]interface{}
+	// Errors maps the command names to the errors to report. Errors takes precedence over Returns.
+	// Once a client connected, use SetError instead.
+	Errors map[string]*qmp.Error
+	// Events are sent before each response, to check the clients discard them
+	Events   []string
+	Greeting qmp.Greeting
+	// Agent makes the Server behave like the guest agent: no greeting, and guest-sync support.
+	// See NewAgentServer.
+	Agent    bool
+	Dir      string // where the socket is created
+	lock     sync.Mutex
+	commands []qmp.Command
+	lis      net.Listener
+}
+
+// NewServer creates and starts a Server, listening on a unix socket in a new temporary directory
+func NewServer() (*Server, error) {
+	return newServer(false)
+}
+
+// NewAgentServer is like NewServer, but the Server behaves like the guest agent
+func NewAgentServer() (*Server, error) {
+	return newServer(true)
+}
+
+func newServer(agent bool) (*Server, error) {
+	dir, err := ioutil.TempDir("", "qmptest")
+	if err != nil {
+		return nil, err
+	}
+	srv := &Server{
+		Returns: make(map[string]interface{}),
+		Errors:  make(map[string]*qmp.Error),
+		Agent:   agent,
+		Dir:     dir,
+	}
+	srv.Greeting.QMP.Version.QEMU.Major = 4
+	srv.Greeting.QMP.Version.QEMU.Minor = 2
+	srv.Greeting.QMP.Capabilities = []string{}
+	srv.lis, err = net.Listen("unix", srv.Path())
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	go srv.serve()
+	return srv, nil
+}
+
+// Path is the path of the QMP socket
+func (srv *Server) Path() string {
+	return filepath.Join(srv.Dir, "qmp.sock")
+}
+
+// SetReturn sets the value to return for the given command
+func (srv *Server) SetReturn(cmd string, ret interface{}) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	delete(srv.Errors, cmd)
+	srv.Returns[cmd] = ret
+}
+
+// SetError sets the error to report for the given command
+func (srv *Server) SetError(cmd string, qmpErr *qmp.Error) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.Errors[cmd] = qmpErr
+}
+
+// Commands returns the commands received so far, in order
+func (srv *Server) Commands() []qmp.Command {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return append([]qmp.Command{}, srv.commands...)
+}
+
+// Close stops the Server and removes its directory
+func (srv *Server) Close() {
+	srv.lis.Close()
+	os.RemoveAll(srv.Dir)
+}
+
+func (srv *Server) serve() {
+	for {
+		conn, err := srv.lis.Accept()
+		if err != nil {
+			return
+		}
+		go srv.handle(conn)
+	}
+}
+
+func (srv *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+
+	if !srv.Agent && enc.Encode(srv.Greeting) != nil {
+		return
+	}
+	for {
+		var cmd qmp.Command
+		if dec.Decode(&cmd) != nil {
+			return
+		}
+		srv.lock.Lock()
+		srv.commands = append(srv.commands, cmd)
+		srv.lock.Unlock()
+
+		for _, event := range srv.Events {
+			if enc.Encode(map[string]string{"event": event}) != nil {
+				return
+			}
+		}
+		if enc.Encode(srv.response(cmd)) != nil {
+			return
+		}
+	}
+}
+
+func (srv *Server) response(command qmp.Command) interface{} {
+	cmd := command.Execute
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if qmpErr, ok := srv.Errors[cmd]; ok {
+		return map[string]interface{}{"error": qmpErr}
+	}
+	if ret, ok := srv.Returns[cmd]; ok {
+		return map[string]interface{}{"return": ret}
+	}
+	if cmd == "qmp_capabilities" && !srv.Agent {
+		return map[string]interface{}{"return": struct{}{}}
+	}
+	if cmd == "guest-sync" && srv.Agent {
+		args, _ := command.Arguments.(map[string]interface{})
+		return map[string]interface{}{"return": args["id"]}
+	}
+	return map[string]interface{}{"error": &qmp.Error{Class: "CommandNotFound", Desc: "The command " + cmd + " has not been found"}}
+}
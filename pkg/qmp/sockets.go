@@ -0,0 +1,133 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package qmp
+
+import (
+	"strings"
+)
+
+// libvirtMonitorID is the id of the chardev libvirt uses to talk to qemu.
+// qemu serves only one client per monitor, and libvirt is always connected to its own.
+const libvirtMonitorID = "charmonitor"
+
+// MonitorSockets finds the paths of the QMP unix sockets in the given qemu command line.
+// Monitors using file descriptors passed by the parent process cannot be reached, and are not reported.
+// The libvirt monitor is never reported: connecting to it would lock libvirt out of its own VM.
+func MonitorSockets(argv []string) []string {
+	chardevs := make(map[string]string) // id -> path
+	var monitors []string               // chardev ids
+	var paths []string
+	for idx := 0; idx+1 < len(argv); idx++ {
+		switch argv[idx] {
+		case "-qmp":
+			// -qmp unix:/path,server=on,wait=off
+			dev := strings.SplitN(argv[idx+1], ",", 2)[0]
+			if strings.HasPrefix(dev, "unix:") {
+				path := strings.TrimPrefix(strings.TrimPrefix(dev, "unix:"), "path=")
+				paths = append(paths, path)
+			}
+		case "-chardev":
+			// -chardev socket,id=charmonitor,path=/path,server=on,wait=off
+			opts := parseOpts(argv[idx+1])
+			if opts[""] == "socket" && opts["path"] != "" {
+				chardevs[opts["id"]] = opts["path"]
+			}
+		case "-mon":
+			// -mon chardev=charmonitor,id=monitor,mode=control
+			opts := parseOpts(argv[idx+1])
+			if opts["mode"] == "control" {
+				monitors = append(monitors, opts["chardev"])
+			}
+		}
+	}
+
+	for _, id := range monitors {
+		path, ok := chardevs[id]
+		if !ok || id == libvirtMonitorID {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// AgentSockets finds the paths of the unix sockets of the guest agent channels dedicated to the metrics collection,
+// named MetricsAgentChannel, in the given qemu command line. The libvirt channel, named GuestAgentChannel, is
+// never reported: the agent serves only one client at a time, and libvirt must not be locked out.
+func AgentSockets(argv []string) []string {
+	chardevs := make(map[string]string) // id -> path
+	var ports []string                  // chardev ids
+	for idx := 0; idx+1 < len(argv); idx++ {
+		switch argv[idx] {
+		case "-chardev":
+			// -chardev socket,id=charchannel0,path=/path/org.qemu.guest_agent.0,server=on,wait=off
+			opts := parseOpts(argv[idx+1])
+			if opts[""] == "socket" && opts["path"] != "" {
+				chardevs[opts["id"]] = opts["path"]
+			}
+		case "-device":
+			// -device virtserialport,bus=virtio-serial0.0,nr=2,chardev=metricsagent,name=org.qemu.guest_agent.metrics
+			opts := parseOpts(argv[idx+1])
+			if opts[""] == "virtserialport" && opts["name"] == MetricsAgentChannel {
+				ports = append(ports, opts["chardev"])
+			}
+		}
+	}
+
+	var paths []string
+	for _, id := range ports {
+		if path, ok := chardevs[id]; ok {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// HasAgentChannel reports whether the given qemu command line has a virtio-serial port with the given name,
+// like GuestAgentChannel or MetricsAgentChannel
+func HasAgentChannel(argv []string, name string) bool {
+	for idx := 0; idx+1 < len(argv); idx++ {
+		if argv[idx] != "-device" {
+			continue
+		}
+		opts := parseOpts(argv[idx+1])
+		if opts[""] == "virtserialport" && opts["name"] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOpts parses a qemu option string, like "socket,id=foo,server=on".
+// The leading value without key, if any, is stored under the empty key.
+func parseOpts(s string) map[string]string {
+	opts := make(map[string]string)
+	for idx, item := range strings.Split(s, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) == 2 {
+			opts[kv[0]] = kv[1]
+		} else if idx == 0 {
+			opts[""] = item
+		} else {
+			opts[item] = "on"
+		}
+	}
+	return opts
+}
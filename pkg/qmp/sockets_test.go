@@ -0,0 +1,129 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2019 Red Hat, Inc.
+ *
+ */
+
+package qmp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMonitorSockets(t *testing.T) {
+	testCases := []struct {
+		name     string
+		argv     []string
+		expected []string
+	}{
+		{
+			name:     "no monitor",
+			argv:     []string{"/usr/libexec/qemu-kvm", "-name", "guest=testvm"},
+			expected: nil,
+		},
+		{
+			name: "libvirt monitor",
+			argv: []string{
+				"/usr/libexec/qemu-kvm",
+				"-chardev", "socket,id=charmonitor,path=/var/lib/libvirt/qemu/domain-1-testvm/monitor.sock,server,nowait",
+				"-mon", "chardev=charmonitor,id=monitor,mode=control",
+			},
+			expected: nil,
+		},
+		{
+			name: "libvirt monitor by fd",
+			argv: []string{
+				"/usr/libexec/qemu-kvm",
+				"-chardev", "socket,id=charmonitor,fd=29,server=on,wait=off",
+				"-mon", "chardev=charmonitor,id=monitor,mode=control",
+			},
+			expected: nil,
+		},
+		{
+			name: "additional monitors",
+			argv: []string{
+				"/usr/libexec/qemu-kvm",
+				"-chardev", "socket,id=charmonitor,path=/var/lib/libvirt/qemu/domain-1-testvm/monitor.sock,server,nowait",
+				"-mon", "chardev=charmonitor,id=monitor,mode=control",
+				"-chardev", "socket,id=charserial0,path=/var/run/serial0,server,nowait",
+				"-chardev", "socket,id=metrics,path=/var/run/metrics.sock,server=on,wait=off",
+				"-mon", "chardev=metrics,mode=control",
+				"-qmp", "unix:/var/run/qmp.sock,server,nowait",
+			},
+			expected: []string{
+				"/var/run/qmp.sock",
+				"/var/run/metrics.sock",
+			},
+		},
+		{
+			name: "human monitor",
+			argv: []string{
+				"/usr/libexec/qemu-kvm",
+				"-chardev", "socket,id=hmp,path=/var/run/hmp.sock,server,nowait",
+				"-mon", "chardev=hmp,mode=readline",
+				"-qmp", "tcp:localhost:4444,server,nowait",
+			},
+			expected: nil,
+		},
+	}
+	for _, tc := range testCases {
+		got := MonitorSockets(tc.argv)
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: unexpected sockets: %#v", tc.name, got)
+		}
+	}
+}
+
+func TestAgentSockets(t *testing.T) {
+	argv := []string{
+		"/usr/libexec/qemu-kvm",
+		"-chardev", "socket,id=charserial0,path=/var/run/serial0,server,nowait",
+		"-device", "isa-serial,chardev=charserial0,id=serial0",
+		"-chardev", "socket,id=charchannel0,path=/var/lib/libvirt/qemu/channel/target/domain-1-testvm/org.qemu.guest_agent.0,server,nowait",
+		"-device", "virtserialport,bus=virtio-serial0.0,nr=1,chardev=charchannel0,id=channel0,name=org.qemu.guest_agent.0",
+		"-chardev", "socket,id=metricsagent,path=/var/run/kubevirt-private/metrics-agent.sock,server=on,wait=off",
+		"-device", "virtserialport,bus=virtio-serial0.0,nr=2,chardev=metricsagent,name=org.qemu.guest_agent.metrics",
+	}
+	expected := []string{"/var/run/kubevirt-private/metrics-agent.sock"}
+	got := AgentSockets(argv)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected sockets: %#v", got)
+	}
+
+	// the libvirt channel is never used
+	got = AgentSockets(argv[:9])
+	if len(got) != 0 {
+		t.Errorf("unexpected sockets: %#v", got)
+	}
+}
+
+func TestHasAgentChannel(t *testing.T) {
+	argv := []string{
+		"/usr/libexec/qemu-kvm",
+		"-chardev", "socket,id=charchannel0,path=/var/lib/libvirt/qemu/channel/target/domain-1-testvm/org.qemu.guest_agent.0,server,nowait",
+		"-device", "virtserialport,bus=virtio-serial0.0,nr=1,chardev=charchannel0,id=channel0,name=org.qemu.guest_agent.0",
+	}
+	if !HasAgentChannel(argv, GuestAgentChannel) {
+		t.Errorf("missing the libvirt channel")
+	}
+	if HasAgentChannel(argv, MetricsAgentChannel) {
+		t.Errorf("unexpected metrics channel")
+	}
+	if HasAgentChannel(argv[:3], GuestAgentChannel) {
+		t.Errorf("unexpected channel without port")
+	}
+}